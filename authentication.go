@@ -2,6 +2,10 @@ package main
 
 // Pure Go sha1 implementation copied from crypto/sha1
 import (
+	"errors"
+	"hash"
+
+	"github.com/tyler-smith/matasano-cryptopals/md4"
 	"github.com/tyler-smith/matasano-cryptopals/sha1"
 )
 
@@ -11,3 +15,85 @@ func Sha1KeyedMAC(key []byte, message []byte) []byte {
 	h.Write(append(key, message...))
 	return h.Sum(nil)
 }
+
+// Md4KeyedMAC prepends a key to the message and returns the md4 digest
+func Md4KeyedMAC(key []byte, message []byte) []byte {
+	h := md4.New()
+	h.Write(append(key, message...))
+	return h.Sum(nil)
+}
+
+// HmacSha1 returns the HMAC (RFC 2104) of the message using sha1
+func HmacSha1(key []byte, message []byte) []byte {
+	if len(key) > sha1.BlockSize {
+		digest := sha1.Sum(key)
+		key = digest[:]
+	}
+
+	innerKey := make([]byte, sha1.BlockSize)
+	outerKey := make([]byte, sha1.BlockSize)
+	copy(innerKey, key)
+	copy(outerKey, key)
+	for i := range innerKey {
+		innerKey[i] ^= 0x36
+		outerKey[i] ^= 0x5c
+	}
+
+	inner := sha1.New()
+	inner.Write(innerKey)
+	inner.Write(message)
+
+	outer := sha1.New()
+	outer.Write(outerKey)
+	outer.Write(inner.Sum(nil))
+
+	return outer.Sum(nil)
+}
+
+// lengthExtendableHash describes a Merkle–Damgård hash whose state can be
+// resumed from a digest, which is all a length extension attack needs
+type lengthExtendableHash struct {
+	// pad returns the message with the hash's own padding appended
+	pad func(message []byte) []byte
+
+	// resume returns a hash starting from the state in digest, which pads as if
+	// length bytes had been written in total
+	resume func(digest []byte, length uint64) hash.Hash
+}
+
+var sha1LengthExtension = lengthExtendableHash{
+	pad: sha1Pad,
+	resume: func(digest []byte, length uint64) hash.Hash {
+		return sha1.NewWithGivenRegisters(sha1HashToRegisters(digest), length)
+	},
+}
+
+var md4LengthExtension = lengthExtendableHash{
+	pad: md4Pad,
+	resume: func(digest []byte, length uint64) hash.Hash {
+		return md4.NewWithGivenRegisters(md4HashToRegisters(digest), length)
+	},
+}
+
+// forgeLengthExtension forges a MAC for message||glue padding||payload given the
+// MAC of message under H(key||message). The key length is unknown so each length
+// from minKeyLength to maxKeyLength is tried until verify accepts the forgery
+func forgeLengthExtension(h lengthExtendableHash, verify func(message []byte, mac []byte) bool, message []byte, mac []byte, payload []byte, minKeyLength int, maxKeyLength int) ([]byte, []byte, error) {
+	for keyLength := minKeyLength; keyLength <= maxKeyLength; keyLength++ {
+		// Pad the message as if it had the key in front of it, then drop the
+		// stand-in key bytes since the victim will prepend the real ones
+		padded := h.pad(append(make([]byte, keyLength), message...))
+		forgedMessage := append(padded[keyLength:], payload...)
+
+		// Pick up hashing where the original MAC left off
+		forger := h.resume(mac, uint64(keyLength+len(forgedMessage)))
+		forger.Write(payload)
+		forgedMAC := forger.Sum(nil)
+
+		if verify(forgedMessage, forgedMAC) {
+			return forgedMessage, forgedMAC, nil
+		}
+	}
+
+	return nil, nil, errors.New("Could not forge a MAC for any key length")
+}
@@ -2,12 +2,14 @@ package main
 
 import (
 	"crypto/aes"
+	"crypto/cipher"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"math/rand"
 	"sort"
+	"time"
 )
 
 //
@@ -74,12 +76,37 @@ func crackRepeatingKeyXor(secret []byte, probableKeyLengths []int) ([]byte, []by
 // AES ECB
 //
 
-func encryptAESECB(message []byte, key []byte) []byte {
-	blockSize := 16
-
+// newAESCipher wraps aes.NewCipher to return ErrInvalidKeySize for bad keys
+func newAESCipher(key []byte) (cipher.Block, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKeySize, err)
+	}
+
+	return block, nil
+}
+
+// checkBlockLength returns ErrInvalidBlockLength if data isn't made of whole blocks
+func checkBlockLength(data []byte, blockSize int) error {
+	if len(data)%blockSize != 0 {
+		return fmt.Errorf("%w: got %d bytes for block size %d", ErrInvalidBlockLength, len(data), blockSize)
+	}
+
+	return nil
+}
+
+// encryptAESECB encrypts a message which is already padded to the block size.
+// It returns ErrInvalidKeySize for a bad key and ErrInvalidBlockLength if the
+// message isn't made of whole blocks
+func encryptAESECB(message []byte, key []byte) ([]byte, error) {
+	block, err := newAESCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	blockSize := block.BlockSize()
+	if err := checkBlockLength(message, blockSize); err != nil {
+		return nil, err
 	}
 
 	cipher := make([]byte, 0, len(message))
@@ -89,15 +116,37 @@ func encryptAESECB(message []byte, key []byte) []byte {
 		cipher = append(cipher, cipherBlock...)
 	}
 
-	return cipher
+	return cipher, nil
 }
 
-func decryptAESECB(secret []byte, key []byte) []byte {
-	block, err := aes.NewCipher(key)
+// mustEncryptAESECB is like encryptAESECB but panics on error
+func mustEncryptAESECB(message []byte, key []byte) []byte {
+	cipher, err := encryptAESECB(message, key)
 	if err != nil {
 		panic(err)
 	}
 
+	return cipher
+}
+
+// encryptAESECBWithPadding pads the message with the given scheme and encrypts it
+func encryptAESECBWithPadding(message []byte, key []byte, padding Padding) ([]byte, error) {
+	return encryptAESECB(padding.Pad(message, aes.BlockSize), key)
+}
+
+// decryptAESECB decrypts the secret, leaving any padding in place. It returns
+// ErrInvalidKeySize for a bad key and ErrInvalidBlockLength if the secret isn't
+// made of whole blocks
+func decryptAESECB(secret []byte, key []byte) ([]byte, error) {
+	block, err := newAESCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkBlockLength(secret, block.BlockSize()); err != nil {
+		return nil, err
+	}
+
 	plaintext := make([]byte, 0, len(secret))
 	for i := 0; i < len(secret); i += 16 {
 		decodedBlock := make([]byte, 16)
@@ -105,9 +154,29 @@ func decryptAESECB(secret []byte, key []byte) []byte {
 		plaintext = append(plaintext, decodedBlock...)
 	}
 
+	return plaintext, nil
+}
+
+// mustDecryptAESECB is like decryptAESECB but panics on error
+func mustDecryptAESECB(secret []byte, key []byte) []byte {
+	plaintext, err := decryptAESECB(secret, key)
+	if err != nil {
+		panic(err)
+	}
+
 	return plaintext
 }
 
+// decryptAESECBWithPadding decrypts the secret and removes the given padding scheme
+func decryptAESECBWithPadding(secret []byte, key []byte, padding Padding) ([]byte, error) {
+	plaintext, err := decryptAESECB(secret, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return padding.Unpad(plaintext, aes.BlockSize)
+}
+
 func isAESECB(bytes []byte, blockSize int) bool {
 	seenBytes := map[string]int{}
 	for i := 0; i < len(bytes); i += blockSize {
@@ -124,92 +193,165 @@ func isAESECB(bytes []byte, blockSize int) bool {
 	return isECB
 }
 
-func crackECB(oracle oracleFunc) []byte {
-	// Determine the size of the oracle's blocks. We will want to create rainbow
-	// lookup tables using prefixes of one less than the block size
-	blockSize := detectECBBlockSize(oracle)
-	rainbowTablePrefixLength := blockSize - 1
+// crackECB recovers the secret an ECB oracle appends to our input, one byte at a
+// time. Queries are recorded with the meter, which may be nil; if the meter's
+// budget runs out the attack stops with an *oracleBudgetError. An oracle which
+// isn't ECB fails with errECBNotDetected.
+//
+// Rather than building a lookup table of 256 queries for every byte, each query
+// carries its own dictionary: one block per candidate byte, each made of the
+// blockSize-1 bytes preceding the unknown byte followed by the candidate. Some
+// padding then lines the unknown byte up at the end of a block further along in
+// the same cipher, so a single query tells us which candidate was right.
+func crackECB(oracle oracleFunc, meter *oracleMeter) ([]byte, error) {
+	meteredOracle := meter.wrap(oracle)
+
+	meter.setPhase("block size")
+	blockSize, err := detectECBBlockSize(meteredOracle)
+	if err != nil {
+		return nil, err
+	}
 
-	// Determine an upper bound on our secret size by encrypted an empty message
-	secretLength := len(oracle([]byte{}))
+	// The oracle may prepend a random number of bytes on each call so only work
+	// with the part of the cipher that we know is aligned after our marker
+	alignedOracle := alignedECBOracle(meteredOracle, blockSize)
 
-	// A slice to hold our leaked secret bytes
-	known := make([]byte, 0, secretLength)
+	meter.setPhase("secret length")
+	secretLength, err := detectECBSecretLength(alignedOracle, blockSize)
+	if err != nil {
+		return nil, err
+	}
 
-	// Iterate until we have a found a pks7padded string, but limit to 10k iterations
-	for i := 0; i < 4000; i++ {
-		knownLength := len(known)
+	meter.setPhase("decrypt")
+	dictionaryLength := 256 * blockSize
 
-		// Build a table of hashes with the given prefix and one unknown byte at the end
-		// The prefix is the last `blockSize-1` byes of the known text, prepended with 0s
-		// if necessary
-		rainbowTablePrefix := make([]byte, rainbowTablePrefixLength)
-		for j := 0; j < rainbowTablePrefixLength; j++ {
-			if knownLength-j < 1 {
-				break
-			}
-			rainbowTablePrefix[rainbowTablePrefixLength-1-j] = known[knownLength-1-j]
+	// Seed the known text with zeros so the first blocks have a full window
+	// of preceding bytes. This matches the zeros we use as alignment padding
+	known := make([]byte, blockSize-1, blockSize-1+secretLength)
+
+	for i := 0; i < secretLength; i++ {
+		window := known[len(known)-(blockSize-1):]
+
+		message := make([]byte, 0, dictionaryLength+blockSize)
+		for candidate := 0; candidate < 256; candidate++ {
+			message = append(message, window...)
+			message = append(message, byte(candidate))
 		}
 
-		table := buildECBTable(oracle, rainbowTablePrefix)
-
-		// Repeatedly call the oracle with random amounts of padding so that eventually
-		// the prefix+nextByte should be aligned perfectly in a block. This allows us to
-		// not be concerned with whether or not the oracle prepends an unknown number of
-		// byte to input. Limit this loop to 10k iterations max.
-		for j := 0; j < 1; j++ {
-			var nextByte byte
-			foundNextByte := false
-
-			// Send a random about of padding to the oracle which will append the secret
-			//text and encrypt it. Eventually our next secret byte should align with a block
-			message := make([]byte, blockSize+rand.Intn(16))
-			// fmt.Println(message)
-			cipher := oracle(message)
-
-			// Scan the cipher for blocks in our lookup table.
-			for k := 0; k < len(cipher); k += blockSize {
-				b, ok := table[string(cipher[k:k+blockSize])]
-				if ok && b != byte(0) {
-					nextByte = b
-					foundNextByte = true
-					break
-				}
-			}
+		// Pad so the secret byte we want is the last byte of a block
+		message = append(message, make([]byte, blockSize-1-(i%blockSize))...)
 
-			// We found the byte so append to it our known text and start looking for the next
-			if foundNextByte {
-				known = append(known, nextByte)
+		cipher, err := alignedOracle(message)
+		if err != nil {
+			return nil, err
+		}
+		targetStart := dictionaryLength + (i/blockSize)*blockSize
+		target := string(cipher[targetStart : targetStart+blockSize])
+
+		found := false
+		for candidate := 0; candidate < 256; candidate++ {
+			if string(cipher[candidate*blockSize:(candidate+1)*blockSize]) == target {
+				known = append(known, byte(candidate))
+				found = true
 				break
 			}
 		}
 
-		if isPks7Padded(known) {
-			fmt.Println("Done.")
-			return pks7Unpad(known)
+		// The secret length is exact so a miss means the attack has failed
+		if !found {
+			return nil, fmt.Errorf("No dictionary block matched byte %d", i)
 		}
 	}
 
-	return known
+	return known[blockSize-1:], nil
 }
 
-func buildECBTable(oracle oracleFunc, prefix []byte) map[string]byte {
-	blockSize := len(prefix) + 1
-	table := map[string]byte{}
+// detectECBSecretLength finds the length of the secret an ECB oracle appends to
+// our input by growing the input until the cipher gains a block of padding
+func detectECBSecretLength(oracle fallibleOracleFunc, blockSize int) (int, error) {
+	base, err := oracle([]byte{})
+	if err != nil {
+		return 0, err
+	}
 
-	for i := 0; i < 256; i++ {
-		b := byte(i)
-		message := append(prefix, b)
+	for i := 1; i <= blockSize; i++ {
+		cipher, err := oracle(make([]byte, i))
+		if err != nil {
+			return 0, err
+		}
+		if len(cipher) > len(base) {
+			return len(base) - i, nil
+		}
+	}
+
+	return len(base), nil
+}
+
+// alignedECBOracleAttempts limits how many times alignedECBOracle will query
+// the underlying oracle before giving up on finding its marker
+const alignedECBOracleAttempts = 10000
+
+// errECBMarkerNotAligned means alignedECBOracle ran out of attempts
+var errECBMarkerNotAligned = errors.New("Oracle never aligned the marker on a block boundary")
+
+// alignedECBOracle wraps an ECB oracle which may prepend an unknown, per-call
+// random prefix to our input. Each message is sent behind a marker of two pairs
+// of identical blocks (XXYY). When the marker shows up in the cipher the prefix
+// ended on a block boundary, and everything after the marker is the encryption
+// of our message as if there was no prefix at all. A misaligned prefix can't
+// produce XXYY since shifting the marker breaks up the second pair.
+func alignedECBOracle(oracle fallibleOracleFunc, blockSize int) fallibleOracleFunc {
+	marker := make([]byte, blockSize*4)
+	for i := range marker {
+		if i < blockSize*2 {
+			marker[i] = 'X'
+		} else {
+			marker[i] = 'Y'
+		}
+	}
+
+	return func(message []byte) ([]byte, error) {
+		input := append(copyBytes(marker), message...)
+
+		for attempt := 0; attempt < alignedECBOracleAttempts; attempt++ {
+			cipher, err := oracle(input)
+			if err != nil {
+				return nil, err
+			}
+
+			if offset := findECBMarker(cipher, blockSize); offset >= 0 {
+				return cipher[offset+len(marker):], nil
+			}
+		}
 
-		block, _ := ecbEncryptedChunkFor(oracle, message, blockSize, 3)
+		return nil, errECBMarkerNotAligned
+	}
+}
 
-		table[string(block)] = b
+// findECBMarker returns the offset of the first XXYY run of cipher blocks, where
+// X != Y, or -1 if there isn't one
+func findECBMarker(cipher []byte, blockSize int) int {
+	blockAt := func(i int) string {
+		return string(cipher[i*blockSize : (i+1)*blockSize])
 	}
 
-	return table
+	for i := 0; i+3 < len(cipher)/blockSize; i++ {
+		x, y := blockAt(i), blockAt(i+2)
+		if x != y && x == blockAt(i+1) && y == blockAt(i+3) {
+			return i * blockSize
+		}
+	}
+
+	return -1
 }
 
-func detectECBBlockSize(oracle oracleFunc) int {
+// errECBNotDetected means the oracle's output never repeated a block for
+// repeated input, so it isn't ECB or not one we can work with
+var errECBNotDetected = errors.New("Oracle doesn't appear to use ECB")
+
+// detectECBBlockSize finds the block size of an ECB oracle by sending runs of
+// identical chunks until their blocks repeat in the cipher
+func detectECBBlockSize(oracle fallibleOracleFunc) (int, error) {
 	// Number of repeating chunks to look for
 	repeatCount := 17
 
@@ -224,26 +366,20 @@ func detectECBBlockSize(oracle oracleFunc) int {
 			newPlaintext = append(newPlaintext, plaintext...)
 		}
 
-		cipher := oracle(newPlaintext)
+		cipher, err := oracle(newPlaintext)
+		if err != nil {
+			return 0, err
+		}
 
 		_, count := findMostCommonBlock(cipher, blockSizeAttempt)
 
 		// We found the correct number (it may not be a perfect boundary so we'll only find repleatCount-1)
 		if count == repeatCount || count == repeatCount-1 {
-			return blockSizeAttempt
+			return blockSizeAttempt, nil
 		}
 	}
 
-	return 0
-}
-
-func ecbEncryptedChunkFor(oracle oracleFunc, plaintext []byte, blockSize int, repeatCount int) ([]byte, int) {
-	// newPlaintext := make([]byte, 0, repeatCount)
-	for i := 0; i < repeatCount; i++ {
-		plaintext = append(plaintext, plaintext...)
-	}
-
-	return findMostCommonBlock(oracle(plaintext), blockSize)
+	return 0, errECBNotDetected
 }
 
 func findMostCommonBlock(bytes []byte, blockSize int) ([]byte, int) {
@@ -321,137 +457,311 @@ func findProbableKeyLengths(data []byte, keyCount int) []int {
 // AES CBC
 //
 
-func encryptAESCBC(message []byte, iv []byte, key []byte) []byte {
-	blockSize := len(key)
-	cipher := []byte{}
+// cbc holds the chaining state shared by the CBC encrypter and decrypter
+type cbc struct {
+	b         cipher.Block
+	blockSize int
+	iv        []byte
+	tmp       []byte
+}
+
+func newCBC(b cipher.Block, iv []byte) *cbc {
+	return &cbc{
+		b:         b,
+		blockSize: b.BlockSize(),
+		iv:        copyBytes(iv),
+		tmp:       make([]byte, b.BlockSize()),
+	}
+}
+
+// cbcEncrypter implements cipher.BlockMode for CBC encryption. The chaining
+// value carries over between calls so input can be streamed in pieces
+type cbcEncrypter cbc
+
+// newCBCEncrypter returns a BlockMode which encrypts in CBC mode using the given
+// Block. The length of iv must be the same as the Block's block size
+func newCBCEncrypter(b cipher.Block, iv []byte) cipher.BlockMode {
+	if len(iv) != b.BlockSize() {
+		panic("newCBCEncrypter: IV length must equal block size")
+	}
+	return (*cbcEncrypter)(newCBC(b, iv))
+}
+
+func (x *cbcEncrypter) BlockSize() int { return x.blockSize }
+
+func (x *cbcEncrypter) CryptBlocks(dst, src []byte) {
+	if len(src)%x.blockSize != 0 {
+		panic("cbcEncrypter: input not full blocks")
+	}
+	if len(dst) < len(src) {
+		panic("cbcEncrypter: output smaller than input")
+	}
+
+	iv := x.iv
+	for i := 0; i < len(src); i += x.blockSize {
+		block := dst[i : i+x.blockSize]
+		for j := 0; j < x.blockSize; j++ {
+			block[j] = src[i+j] ^ iv[j]
+		}
+		x.b.Encrypt(block, block)
+		iv = block
+	}
+
+	// Remember the last cipher block so the next call continues the chain
+	copy(x.iv, iv)
+}
+
+// cbcDecrypter implements cipher.BlockMode for CBC decryption. The chaining
+// value carries over between calls so input can be streamed in pieces
+type cbcDecrypter cbc
+
+// newCBCDecrypter returns a BlockMode which decrypts in CBC mode using the given
+// Block. The length of iv must be the same as the Block's block size
+func newCBCDecrypter(b cipher.Block, iv []byte) cipher.BlockMode {
+	if len(iv) != b.BlockSize() {
+		panic("newCBCDecrypter: IV length must equal block size")
+	}
+	return (*cbcDecrypter)(newCBC(b, iv))
+}
+
+func (x *cbcDecrypter) BlockSize() int { return x.blockSize }
+
+func (x *cbcDecrypter) CryptBlocks(dst, src []byte) {
+	if len(src)%x.blockSize != 0 {
+		panic("cbcDecrypter: input not full blocks")
+	}
+	if len(dst) < len(src) {
+		panic("cbcDecrypter: output smaller than input")
+	}
+
+	for i := 0; i < len(src); i += x.blockSize {
+		// Hold on to the cipher block before decrypting since dst and src may overlap
+		copy(x.tmp, src[i:i+x.blockSize])
+
+		block := dst[i : i+x.blockSize]
+		x.b.Decrypt(block, x.tmp)
+		for j := 0; j < x.blockSize; j++ {
+			block[j] ^= x.iv[j]
+		}
+
+		x.iv, x.tmp = x.tmp, x.iv
+	}
+}
+
+// encryptAESCBC encrypts the message, PKCS#7 padding it first only if it isn't
+// already a whole number of blocks. It returns ErrInvalidKeySize for a bad key
+// and ErrInvalidBlockLength for an IV which isn't one block long
+func encryptAESCBC(message []byte, iv []byte, key []byte) ([]byte, error) {
+	block, err := newAESCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	blockSize := block.BlockSize()
+	if len(iv) != blockSize {
+		return nil, fmt.Errorf("%w: IV is %d bytes", ErrInvalidBlockLength, len(iv))
+	}
 
 	if (len(message) % blockSize) > 0 {
 		message = pks7Pad(message, blockSize)
 	}
-	for i := 0; i < len(message); i += blockSize {
-		plainBlock := message[i : i+blockSize]
-		cipherBlock := encryptAESECB(calculateXor(plainBlock, iv), key)
-		iv = cipherBlock
 
-		cipher = append(cipher, cipherBlock...)
+	cipher := make([]byte, len(message))
+	newCBCEncrypter(block, iv).CryptBlocks(cipher, message)
+
+	return cipher, nil
+}
+
+// mustEncryptAESCBC is like encryptAESCBC but panics on error
+func mustEncryptAESCBC(message []byte, iv []byte, key []byte) []byte {
+	cipher, err := encryptAESCBC(message, iv, key)
+	if err != nil {
+		panic(err)
 	}
 
 	return cipher
 }
 
-func decryptAESCBC(secret []byte, iv []byte, key []byte) []byte {
-	blockSize := len(key)
-	plaintext := []byte{}
+// encryptAESCBCWithPadding pads the message with the given scheme and encrypts
+// it. Unlike encryptAESCBC the message is always padded, even when it's already
+// a whole number of blocks
+func encryptAESCBCWithPadding(message []byte, iv []byte, key []byte, padding Padding) ([]byte, error) {
+	return encryptAESCBC(padding.Pad(message, aes.BlockSize), iv, key)
+}
 
-	for i := 0; i < len(secret); i += blockSize {
-		cipherBlock := secret[i : i+blockSize]
-		plaintext = append(plaintext, calculateXor(decryptAESECB(cipherBlock, key), iv)...)
-		iv = cipherBlock
+// decryptAESCBC decrypts the secret, leaving any padding in place. It returns
+// ErrInvalidKeySize for a bad key and ErrInvalidBlockLength if the IV or secret
+// aren't made of whole blocks
+func decryptAESCBC(secret []byte, iv []byte, key []byte) ([]byte, error) {
+	block, err := newAESCipher(key)
+	if err != nil {
+		return nil, err
 	}
 
-	return plaintext
-}
+	blockSize := block.BlockSize()
+	if len(iv) != blockSize {
+		return nil, fmt.Errorf("%w: IV is %d bytes", ErrInvalidBlockLength, len(iv))
+	}
+	if err := checkBlockLength(secret, blockSize); err != nil {
+		return nil, err
+	}
 
-func crackCBCWithPaddingOracle(cipher []byte, iv []byte) ([]byte, error) {
-	blockLength := len(iv)
-	plaintextLength := len(cipher)
+	plaintext := make([]byte, len(secret))
+	newCBCDecrypter(block, iv).CryptBlocks(plaintext, secret)
 
-	// Holder for our solved bytes
-	plaintext := make([]byte, plaintextLength)
+	return plaintext, nil
+}
 
-	// Iterate over each 0-based block index in reverse order
-	for block := (plaintextLength / blockLength) - 1; block >= 0; block-- {
-		// Iterate over each 0-based block element index in reverse order
-		for element := blockLength - 1; element >= 0; element-- {
-			// Assume this element is the first element of padding, determine what the
-			// padding length should be (0 for first element of block; blockLength-1 for last)
-			paddingLength := blockLength - element
-			paddingByte := byte(paddingLength)
+// mustDecryptAESCBC is like decryptAESCBC but panics on error
+func mustDecryptAESCBC(secret []byte, iv []byte, key []byte) []byte {
+	plaintext, err := decryptAESCBC(secret, iv, key)
+	if err != nil {
+		panic(err)
+	}
 
-			// The cipher for this block
-			cipherBlock := cipher[block*blockLength : (block+1)*blockLength]
+	return plaintext
+}
 
-			// The cipher for the previous block
-			// It should be the iv if the current block is block 0
-			c := iv
-			if block > 0 {
-				c = cipher[(block-1)*blockLength : block*blockLength]
-			}
+// decryptAESCBCWithPadding decrypts the secret and removes the given padding scheme
+func decryptAESCBCWithPadding(secret []byte, iv []byte, key []byte, padding Padding) ([]byte, error) {
+	plaintext, err := decryptAESCBC(secret, iv, key)
+	if err != nil {
+		return nil, err
+	}
 
-			// The poisioned block we will use to determine the intermediate state
-			cPrime := make([]byte, len(c))
-			copy(cPrime, c)
+	return padding.Unpad(plaintext, len(iv))
+}
 
-			// Set each element of the block that we've already calculated such that
-			// after decrypting they will equal the current padding byte
-			for j := blockLength - 1; j > element; j-- {
-				cPrime[j] ^= plaintext[(block*blockLength)+j] ^ paddingByte
-			}
+// crackCBCKeyAsIV recovers the key from a CBC encrypter which uses its key as the
+// IV. The receiver must complain about high-ASCII plaintext by returning a
+// *highASCIIError, which leaks the decrypted plaintext back to us.
+//
+// Decrypting C1||0||C1 gives P'1 = D(C1)^K and P'3 = D(C1)^0, so P'1^P'3 = K
+func crackCBCKeyAsIV(encrypter func([]byte) []byte, receiver func([]byte) error) ([]byte, error) {
+	blockSize := 16
+	cipher := encrypter(make([]byte, blockSize*3))
 
-			// Try setting the elements before this one to random garbage to hopefully
-			// prevent them from XORing to real padding which can screw us up
-			for i := element - 1; i >= 0; i-- {
-				cPrime[i] = byte(rand.Intn(256))
-			}
+	c1 := cipher[:blockSize]
+	forged := make([]byte, 0, blockSize*3)
+	forged = append(forged, c1...)
+	forged = append(forged, make([]byte, blockSize)...)
+	forged = append(forged, c1...)
 
-			// Try all possible bytes until we find the one that decrypts to a correctly padded
-			// text. This tells us this element decrypts and XORs to `paddingByte` so we can
-			// determine the inermediate state, and then the plaintext
-			for cPrimeAttempt := 0; cPrimeAttempt < 256; cPrimeAttempt++ {
-				cPrime[element] = byte(cPrimeAttempt)
-
-				if checkEncryptedCNCPadding(cipherBlock, cPrime) {
-					break
-				} else if cPrimeAttempt == 255 {
-					return nil, errors.New("No correct cPrime byte found")
-				}
-			}
+	err := receiver(forged)
+	if err == nil {
+		return nil, errors.New("Receiver accepted the forged cipher")
+	}
 
-			// Calculate the plain text for this byte and put it in our plaintext byte slice
-			plaintext[(block*blockLength)+element] = c[element] ^ cPrime[element] ^ paddingByte
-		}
+	asciiErr, ok := err.(*highASCIIError)
+	if !ok {
+		return nil, err
 	}
 
-	return plaintext, nil
+	plaintext := asciiErr.plaintext
+	return calculateXor(plaintext[:blockSize], plaintext[blockSize*2:blockSize*3]), nil
 }
 
 //
 // AES CTR
 //
 
-func calculateAESCTRWithOffset(message []byte, key []byte, nonce []byte, offset int) []byte {
-	cipher := copyBytes(message)
+// ctr implements cipher.Stream for CTR mode as used by the challenges. Each
+// keystream block is the encryption of nonce||le64(counter), where the nonce
+// fills the rest of the block
+type ctr struct {
+	b         cipher.Block
+	block     []byte
+	keystream []byte
+	counter   uint64
+	used      int
+}
 
-	// Iterate over each byte to encrypt
-	// For each block we'll generate a fresh keystream
-	counter := offset
-	var keystreamBlockBytes []byte
-	for i := range cipher {
-		blockElementcounter := counter % 16
+// newCTR returns a Stream which encrypts/decrypts using the given Block in CTR
+// mode. The nonce must be 8 bytes shorter than the block size
+func newCTR(b cipher.Block, nonce []byte) *ctr {
+	blockSize := b.BlockSize()
+	if len(nonce) != blockSize-8 {
+		panic("newCTR: nonce length must be block size minus 8")
+	}
 
-		// Need to generate a keystream
-		if counter == offset || blockElementcounter == 0 {
-			blockCounter := counter / 16
+	block := make([]byte, blockSize)
+	copy(block, nonce)
 
-			// Get 8 little endian bytes for the 64bit counter
-			blockCounterBytes := make([]byte, 8)
-			binary.PutUvarint(blockCounterBytes, uint64(blockCounter))
+	x := &ctr{
+		b:         b,
+		block:     block,
+		keystream: make([]byte, blockSize),
+	}
+	x.refill()
+
+	return x
+}
+
+// refill generates the keystream block for the current counter
+func (x *ctr) refill() {
+	binary.LittleEndian.PutUint64(x.block[len(x.block)-8:], x.counter)
+	x.b.Encrypt(x.keystream, x.block)
+	x.used = 0
+}
+
+// seek moves the stream to the given byte offset in the keystream
+func (x *ctr) seek(offset uint64) {
+	blockSize := uint64(len(x.keystream))
+	x.counter = offset / blockSize
+	x.refill()
+	x.used = int(offset % blockSize)
+}
+
+func (x *ctr) XORKeyStream(dst, src []byte) {
+	if len(dst) < len(src) {
+		panic("ctr: output smaller than input")
+	}
 
-			// Generate the key stream for the key and nonce
-			seed := append(nonce, blockCounterBytes...)
-			keystreamBlockBytes = encryptAESCBC(seed, nonce, key)
+	for i := range src {
+		if x.used == len(x.keystream) {
+			x.counter++
+			x.refill()
 		}
 
-		// XOR the plaintext byte with our keystream key
-		cipher[i] ^= keystreamBlockBytes[blockElementcounter]
-		counter++
+		dst[i] = src[i] ^ x.keystream[x.used]
+		x.used++
+	}
+}
+
+// calculateAESCTRWithOffset encrypts or decrypts the message with the keystream
+// starting offset bytes in. It returns ErrInvalidKeySize for a bad key and
+// ErrInvalidBlockLength for a nonce which isn't 8 bytes shorter than a block
+func calculateAESCTRWithOffset(message []byte, key []byte, nonce []byte, offset int) ([]byte, error) {
+	block, err := newAESCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(nonce) != block.BlockSize()-8 {
+		return nil, fmt.Errorf("%w: nonce is %d bytes", ErrInvalidBlockLength, len(nonce))
+	}
+
+	stream := newCTR(block, nonce)
+	stream.seek(uint64(offset))
+
+	cipher := make([]byte, len(message))
+	stream.XORKeyStream(cipher, message)
+
+	return cipher, nil
+}
+
+// mustCalculateAESCTRWithOffset is like calculateAESCTRWithOffset but panics on error
+func mustCalculateAESCTRWithOffset(message []byte, key []byte, nonce []byte, offset int) []byte {
+	cipher, err := calculateAESCTRWithOffset(message, key, nonce, offset)
+	if err != nil {
+		panic(err)
 	}
 
 	return cipher
 }
 
 func calculateAESCTR(message []byte, key []byte, nonce []byte) []byte {
-	return calculateAESCTRWithOffset(message, key, nonce, 0)
+	return mustCalculateAESCTRWithOffset(message, key, nonce, 0)
 }
 
 func encryptAESCTR(message []byte, key []byte) []byte {
@@ -471,7 +781,7 @@ func editAESCTR(cipher []byte, key []byte, offset int, newtext []byte) []byte {
 	nonce := copyBytes(cipher[:8])
 
 	// Encrypt the new text
-	newCipherText := calculateAESCTRWithOffset(newtext, key, nonce, offset)
+	newCipherText := mustCalculateAESCTRWithOffset(newtext, key, nonce, offset)
 
 	newCipher := copyBytes(cipher)
 
@@ -489,75 +799,119 @@ func editAESCTR(cipher []byte, key []byte, offset int, newtext []byte) []byte {
 	return newCipher
 }
 
-//
-// MT19937 Stream Cipher
-//
+// ctrPin fixes the plaintext byte at an offset of one of the ciphers given to
+// crackFixedNonceCTR
+type ctrPin struct {
+	cipher int
+	offset int
+	value  byte
+}
 
-func calculateMT19937(message []byte, key []byte) []byte {
-	if len(key) != 16 {
-		panic("key must be 16 bytes in length")
+// crackFixedNonceCTR recovers as much keystream as possible from ciphers which
+// were all encrypted with the same key and nonce. Ciphers may have different
+// lengths; each keystream column is guessed independently by frequency scoring
+// the bytes of every cipher long enough to reach it. Pinned plaintext bytes fix
+// their column outright. The confidence for each column is between 0 and 1 and
+// reflects how far ahead the best guess was of the runner up. A pin outside of
+// the ciphers is an error
+func crackFixedNonceCTR(ciphers [][]byte, pins []ctrPin) ([]byte, []float64, error) {
+	for i, pin := range pins {
+		if pin.cipher < 0 || pin.cipher >= len(ciphers) {
+			return nil, nil, fmt.Errorf("pin %d: cipher %d out of range", i, pin.cipher)
+		}
+		if pin.offset < 0 || pin.offset >= len(ciphers[pin.cipher]) {
+			return nil, nil, fmt.Errorf("pin %d: offset %d out of range for cipher %d", i, pin.offset, pin.cipher)
+		}
 	}
 
-	keyInt, _ := binary.Uvarint(key[0:16])
-	mt := newMersenneTwister(int(keyInt))
-
-	cipher := make([]byte, len(message))
-	for i := 0; i < len(cipher); i++ {
-		cipher[i] = byte(mt.next()) ^ message[i]
+	keystreamLength := 0
+	for _, cipher := range ciphers {
+		if len(cipher) > keystreamLength {
+			keystreamLength = len(cipher)
+		}
 	}
 
-	return cipher
-}
+	keystream := make([]byte, keystreamLength)
+	confidence := make([]float64, keystreamLength)
 
-//
-// PKS7
-//
+	for column := 0; column < keystreamLength; column++ {
+		columnBytes := []byte{}
+		for _, cipher := range ciphers {
+			if column < len(cipher) {
+				columnBytes = append(columnBytes, cipher[column])
+			}
+		}
 
-func pks7Pad(data []byte, blockSize int) []byte {
-	paddedData := data
-	padSize := blockSize - (len(data) % blockSize)
-	for i := padSize; i > 0; i-- {
-		paddedData = append(paddedData, byte(padSize))
+		keystream[column], confidence[column] = crackKeystreamColumn(columnBytes)
 	}
-	return paddedData
-}
 
-func pks7Unpad(data []byte) []byte {
-	if !isPks7Padded(data) {
-		return data
+	for _, pin := range pins {
+		keystream[pin.offset] = ciphers[pin.cipher][pin.offset] ^ pin.value
+		confidence[pin.offset] = 1
 	}
 
-	dataLength := len(data)
-	padLength := int(data[dataLength-1])
-
-	return data[0 : dataLength-padLength]
+	return keystream, confidence, nil
 }
 
-func isPks7Padded(data []byte) bool {
-	dataLength := len(data)
-	if dataLength == 0 {
-		return false
+// crackKeystreamColumn finds the most likely single keystream byte for bytes
+// which were all XORed with it, along with a confidence in that guess
+func crackKeystreamColumn(column []byte) (byte, float64) {
+	var best byte
+	bestScore, secondScore := float64(0), float64(0)
+
+	for i := 0; i < 256; i++ {
+		score := englishFrequencyScore(calculateXor(column, []byte{byte(i)}))
+
+		if score > bestScore {
+			best, bestScore, secondScore = byte(i), score, bestScore
+		} else if score > secondScore {
+			secondScore = score
+		}
 	}
 
-	padLength := int(data[dataLength-1])
+	if bestScore == 0 {
+		return best, 0
+	}
 
-	if padLength == 0 || dataLength < padLength {
-		return false
+	return best, (bestScore - secondScore) / bestScore
+}
+
+//
+// MT19937 Stream Cipher
+//
+
+// calculateMT19937 encrypts or decrypts the message with an MT19937 keystream
+// seeded from the key. It returns ErrInvalidKeySize if the key isn't 16 bytes
+func calculateMT19937(message []byte, key []byte) ([]byte, error) {
+	if len(key) != 16 {
+		return nil, fmt.Errorf("%w: key must be 16 bytes in length", ErrInvalidKeySize)
 	}
 
-	for i := 0; i < padLength; i++ {
-		if int(data[dataLength-i-1]) != padLength {
-			return false
-		}
+	keyInt, _ := binary.Uvarint(key[0:16])
+	return calculateMT19937WithSeed(message, uint32(keyInt)), nil
+}
+
+// mustCalculateMT19937 is like calculateMT19937 but panics on error
+func mustCalculateMT19937(message []byte, key []byte) []byte {
+	cipher, err := calculateMT19937(message, key)
+	if err != nil {
+		panic(err)
 	}
 
-	return true
+	return cipher
 }
 
-func validatePks7Padded(data []byte) {
-	if !isPks7Padded(data) {
-		panic("Data must be pks7 padded")
+// calculateMT19937WithSeed encrypts or decrypts the message with the low byte of
+// each output of an MT19937 seeded with seed
+func calculateMT19937WithSeed(message []byte, seed uint32) []byte {
+	mt := NewMT19937(seed)
+
+	cipher := make([]byte, len(message))
+	for i := 0; i < len(cipher); i++ {
+		cipher[i] = byte(mt.Uint32()) ^ message[i]
 	}
+
+	return cipher
 }
 
 //
@@ -585,7 +939,7 @@ func ecbCipherOracle(message []byte) []byte {
 	message = append(message, unknownECBOracleSecret...)
 	message = pks7Pad(message, 16)
 
-	return encryptAESECB(message, unknownOracleKey)
+	return mustEncryptAESECB(message, unknownOracleKey)
 }
 
 func ecbCipherWithPrependOrcale(message []byte) []byte {
@@ -598,29 +952,91 @@ func ecbCipherWithPrependOrcale(message []byte) []byte {
 
 var cbcPaddingOracleIteration = 0
 
-func cbcPaddingOracle(iv []byte) []byte {
+func cbcPaddingOracle(iv []byte, padding Padding) []byte {
 	prepareCipherOracles()
 
 	possibleMessages := [][]byte{
-		base64ToBytes("MDAwMDAwTm93IHRoYXQgdGhlIHBhcnR5IGlzIGp1bXBpbmc="),
-		base64ToBytes("MDAwMDAxV2l0aCB0aGUgYmFzcyBraWNrZWQgaW4gYW5kIHRoZSBWZWdhJ3MgYXJlIHB1bXBpbic="),
-		base64ToBytes("MDAwMDAyUXVpY2sgdG8gdGhlIHBvaW50LCB0byB0aGUgcG9pbnQsIG5vIGZha2luZw=="),
-		base64ToBytes("MDAwMDAzQ29va2luZyBNQydzIGxpa2UgYSBwb3VuZCBvZiBiYWNvbg=="),
-		base64ToBytes("MDAwMDA0QnVybmluZyAnZW0sIGlmIHlvdSBhaW4ndCBxdWljayBhbmQgbmltYmxl"),
-		base64ToBytes("MDAwMDA1SSBnbyBjcmF6eSB3aGVuIEkgaGVhciBhIGN5bWJhbA=="),
-		base64ToBytes("MDAwMDA2QW5kIGEgaGlnaCBoYXQgd2l0aCBhIHNvdXBlZCB1cCB0ZW1wbw=="),
-		base64ToBytes("MDAwMDA3SSdtIG9uIGEgcm9sbCwgaXQncyB0aW1lIHRvIGdvIHNvbG8="),
-		base64ToBytes("MDAwMDA4b2xsaW4nIGluIG15IGZpdmUgcG9pbnQgb2g="),
-		base64ToBytes("MDAwMDA5aXRoIG15IHJhZy10b3AgZG93biBzbyBteSBoYWlyIGNhbiBibG93"),
+		mustBase64ToBytes("MDAwMDAwTm93IHRoYXQgdGhlIHBhcnR5IGlzIGp1bXBpbmc="),
+		mustBase64ToBytes("MDAwMDAxV2l0aCB0aGUgYmFzcyBraWNrZWQgaW4gYW5kIHRoZSBWZWdhJ3MgYXJlIHB1bXBpbic="),
+		mustBase64ToBytes("MDAwMDAyUXVpY2sgdG8gdGhlIHBvaW50LCB0byB0aGUgcG9pbnQsIG5vIGZha2luZw=="),
+		mustBase64ToBytes("MDAwMDAzQ29va2luZyBNQydzIGxpa2UgYSBwb3VuZCBvZiBiYWNvbg=="),
+		mustBase64ToBytes("MDAwMDA0QnVybmluZyAnZW0sIGlmIHlvdSBhaW4ndCBxdWljayBhbmQgbmltYmxl"),
+		mustBase64ToBytes("MDAwMDA1SSBnbyBjcmF6eSB3aGVuIEkgaGVhciBhIGN5bWJhbA=="),
+		mustBase64ToBytes("MDAwMDA2QW5kIGEgaGlnaCBoYXQgd2l0aCBhIHNvdXBlZCB1cCB0ZW1wbw=="),
+		mustBase64ToBytes("MDAwMDA3SSdtIG9uIGEgcm9sbCwgaXQncyB0aW1lIHRvIGdvIHNvbG8="),
+		mustBase64ToBytes("MDAwMDA4b2xsaW4nIGluIG15IGZpdmUgcG9pbnQgb2g="),
+		mustBase64ToBytes("MDAwMDA5aXRoIG15IHJhZy10b3AgZG93biBzbyBteSBoYWlyIGNhbiBibG93"),
 	}
 
 	message := possibleMessages[rand.Intn(len(possibleMessages))]
 
-	return encryptAESCBC(message, iv, unknownOracleKey)
+	cipher, err := encryptAESCBCWithPadding(message, iv, unknownOracleKey, padding)
+	if err != nil {
+		panic(err)
+	}
+
+	return cipher
+}
+
+func checkEncryptedCNCPadding(cipher []byte, iv []byte, padding Padding) bool {
+	plaintext, err := decryptAESCBC(cipher, iv, unknownOracleKey)
+	if err != nil {
+		return false
+	}
+
+	_, err = padding.Unpad(plaintext, len(iv))
+	return err == nil
+}
+
+// localPaddingOracle adapts checkEncryptedCNCPadding to a paddingOracle
+func localPaddingOracle(padding Padding) paddingOracle {
+	return func(iv []byte, ciphertext []byte) (bool, error) {
+		return checkEncryptedCNCPadding(ciphertext, iv, padding), nil
+	}
+}
+
+// errCBCDecryptionFailed is the only error cbcNonLeakyReceiver gives
+var errCBCDecryptionFailed = errors.New("Decryption failed")
+
+// cbcNonLeakyReceiver decrypts and unpads a cipher from cbcPaddingOracle. Unlike
+// checkEncryptedCNCPadding it checks the padding in constant time, so how long
+// it takes to reject a cipher says nothing about the padding
+func cbcNonLeakyReceiver(cipher []byte, iv []byte) ([]byte, error) {
+	prepareCipherOracles()
+
+	plaintext, err := decryptAESCBC(cipher, iv, unknownOracleKey)
+	if err != nil || !isPks7PaddedConstantTime(plaintext, len(iv)) {
+		return nil, errCBCDecryptionFailed
+	}
+
+	return plaintext[:len(plaintext)-int(plaintext[len(plaintext)-1])], nil
 }
 
-func checkEncryptedCNCPadding(cipher []byte, iv []byte) bool {
-	return isPks7Padded(decryptAESCBC(cipher, iv, unknownOracleKey))
+// unknownMT19937Seed is the 16-bit seed used by mt19937PrefixOracle
+var unknownMT19937Seed uint16
+
+// mt19937PrefixOracle encrypts a random number of random bytes followed by the
+// plaintext with the MT19937 stream cipher and a random 16-bit seed
+func mt19937PrefixOracle(plaintext []byte) []byte {
+	if unknownMT19937Seed == 0 {
+		unknownMT19937Seed = uint16(1 + rand.Intn(0xffff))
+	}
+
+	message := append(randomBytes(5+rand.Intn(20)), plaintext...)
+	return calculateMT19937WithSeed(message, uint32(unknownMT19937Seed))
+}
+
+// mt19937ResetToken makes a 16 byte password reset token from the first outputs
+// of an MT19937 seeded with the given time
+func mt19937ResetToken(now time.Time) []byte {
+	mt := NewMT19937(uint32(now.Unix()))
+
+	token := make([]byte, 16)
+	for i := 0; i < len(token); i += 4 {
+		binary.BigEndian.PutUint32(token[i:], mt.Uint32())
+	}
+
+	return token
 }
 
 func ctrEditOracleEncrypter(plaintext []byte) []byte {
@@ -632,3 +1048,34 @@ func ctrEditOracleEditor(cipher []byte, offset int, newtext []byte) []byte {
 	prepareCipherOracles()
 	return editAESCTR(cipher, unknownOracleKey, offset, newtext)
 }
+
+// highASCIIError is returned by cbcKeyAsIVReceiver when the plaintext isn't
+// valid ASCII. It (unwisely) includes the offending plaintext
+type highASCIIError struct {
+	plaintext []byte
+}
+
+func (e *highASCIIError) Error() string {
+	return fmt.Sprintf("Plaintext contains high-ASCII bytes: %q", e.plaintext)
+}
+
+func cbcKeyAsIVEncrypter(message []byte) []byte {
+	prepareCipherOracles()
+	return mustEncryptAESCBC(message, unknownOracleKey, unknownOracleKey)
+}
+
+func cbcKeyAsIVReceiver(cipher []byte) error {
+	prepareCipherOracles()
+	plaintext, err := decryptAESCBC(cipher, unknownOracleKey, unknownOracleKey)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range plaintext {
+		if b > 127 {
+			return &highASCIIError{plaintext: plaintext}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+// Package dh implements finite field Diffie-Hellman key exchange.
+package dh
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/tyler-smith/matasano-cryptopals/sha1"
+)
+
+// ErrInvalidPublicKey is returned for a peer's public value which would leave
+// the shared secret in a tiny set of values
+var ErrInvalidPublicKey = errors.New("invalid public key")
+
+// ErrInvalidGroup is returned for a group which keys can't be generated in
+var ErrInvalidGroup = errors.New("invalid group")
+
+// Group is a Diffie-Hellman group: a prime modulus P and generator G. When P is
+// a safe prime Q is (P-1)/2, the order of the subgroup public values must lie in.
+// A nil Q skips that check
+type Group struct {
+	P *big.Int
+	G *big.Int
+	Q *big.Int
+}
+
+// RFC3526Group1536 is the 1536-bit MODP group from RFC 3526, as used in
+// Challenge 33
+var RFC3526Group1536 = NewSafePrimeGroup(hexToBigInt(
+	"ffffffffffffffffc90fdaa22168c234c4c6628b80dc1cd129024e088a67cc74"+
+		"020bbea63b139b22514a08798e3404ddef9519b3cd3a431b302b0a6df25f1437"+
+		"4fe1356d6d51c245e485b576625e7ec6f44c42e9a637ed6b0bff5cb6f406b7ed"+
+		"ee386bfb5a899fa5ae9f24117c4b1fe649286651ece45b3dc2007cb8a163bf05"+
+		"98da48361c55d39a69163fa8fd24cf5f83655d23dca3ad961c62f356208552bb"+
+		"9ed529077096966d670c354e4abc9804f1746c08ca237327ffffffffffffffff"), big.NewInt(2))
+
+// NewSafePrimeGroup returns the group for the safe prime p and generator g
+func NewSafePrimeGroup(p *big.Int, g *big.Int) *Group {
+	q := new(big.Int).Sub(p, big.NewInt(1))
+	q.Rsh(q, 1)
+
+	return &Group{P: p, G: g, Q: q}
+}
+
+// hexToBigInt parses a hex constant, panicking if it's malformed
+func hexToBigInt(hexString string) *big.Int {
+	n, ok := new(big.Int).SetString(hexString, 16)
+	if !ok {
+		panic(fmt.Sprintf("invalid hex integer %q", hexString))
+	}
+
+	return n
+}
+
+// KeyPair is a private exponent and the matching public value G^Private mod P
+type KeyPair struct {
+	Group   *Group
+	Private *big.Int
+	Public  *big.Int
+}
+
+// Validate returns ErrInvalidGroup unless P and G are set and P is at least 5,
+// the smallest prime with a private exponent to pick from [2, P-2]
+func (g *Group) Validate() error {
+	if g.P == nil || g.G == nil {
+		return fmt.Errorf("%w: missing p or g", ErrInvalidGroup)
+	}
+	if g.P.Cmp(big.NewInt(5)) < 0 {
+		return fmt.Errorf("%w: p %v is too small", ErrInvalidGroup, g.P)
+	}
+
+	return nil
+}
+
+// GenerateKey returns a new key pair with a private exponent from crypto/rand
+func (g *Group) GenerateKey() (*KeyPair, error) {
+	if err := g.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Pick from [2, p-2] so the public value is never trivial
+	limit := new(big.Int).Sub(g.P, big.NewInt(3))
+	private, err := rand.Int(rand.Reader, limit)
+	if err != nil {
+		return nil, err
+	}
+	private.Add(private, big.NewInt(2))
+
+	return g.KeyPair(private), nil
+}
+
+// KeyPair returns the key pair for a known private exponent
+func (g *Group) KeyPair(private *big.Int) *KeyPair {
+	return &KeyPair{Group: g, Private: private, Public: new(big.Int).Exp(g.G, private, g.P)}
+}
+
+// ValidatePublic returns ErrInvalidPublicKey unless the peer's public value is in
+// (1, P-1) and, for safe prime groups, in the subgroup of order Q. Anything else
+// would let the peer force the shared secret into a tiny set of values
+func (g *Group) ValidatePublic(public *big.Int) error {
+	pMinusOne := new(big.Int).Sub(g.P, big.NewInt(1))
+	if public.Cmp(big.NewInt(1)) <= 0 || public.Cmp(pMinusOne) >= 0 {
+		return fmt.Errorf("%w: public value out of range", ErrInvalidPublicKey)
+	}
+
+	if g.Q != nil && new(big.Int).Exp(public, g.Q, g.P).Cmp(big.NewInt(1)) != 0 {
+		return fmt.Errorf("%w: public value not in the prime order subgroup", ErrInvalidPublicKey)
+	}
+
+	return nil
+}
+
+// SharedSecret returns peer^Private mod P after validating the peer's public value
+func (k *KeyPair) SharedSecret(peer *big.Int) (*big.Int, error) {
+	if err := k.Group.ValidatePublic(peer); err != nil {
+		return nil, err
+	}
+
+	return k.UncheckedSharedSecret(peer), nil
+}
+
+// UncheckedSharedSecret is SharedSecret without validating the peer's public
+// value, like a naive implementation would
+func (k *KeyPair) UncheckedSharedSecret(peer *big.Int) *big.Int {
+	return new(big.Int).Exp(peer, k.Private, k.Group.P)
+}
+
+// AESKey derives a 16 byte AES key from a shared secret: the first 16 bytes of
+// the SHA-1 of its big endian bytes
+func AESKey(secret *big.Int) []byte {
+	digest := sha1.Sum(secret.Bytes())
+	return digest[:16]
+}
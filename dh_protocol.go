@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"sync"
+
+	"github.com/tyler-smith/matasano-cryptopals/dh"
+)
+
+// errDHConnectionClosed is returned when the other end hangs up mid-protocol
+var errDHConnectionClosed = errors.New("Connection closed")
+
+// errDHMissingPublic is returned when the peer's public value never arrives
+var errDHMissingPublic = errors.New("Message has no public value")
+
+// dhMessage is one message of the DH echo protocol. The key exchange sets the
+// group (A to B only) and the public value; after that only data is sent, which
+// is an AES-CBC cipher followed by its IV
+type dhMessage struct {
+	p      *big.Int
+	g      *big.Int
+	public *big.Int
+	data   []byte
+}
+
+// dhConn is one end of a connection between two parties. Closing send hangs up
+type dhConn struct {
+	send    chan<- dhMessage
+	receive <-chan dhMessage
+}
+
+// dhPipe returns both ends of a new connection
+func dhPipe() (dhConn, dhConn) {
+	ab := make(chan dhMessage)
+	ba := make(chan dhMessage)
+
+	return dhConn{send: ab, receive: ba}, dhConn{send: ba, receive: ab}
+}
+
+func (c dhConn) read() (dhMessage, error) {
+	message, ok := <-c.receive
+	if !ok {
+		return dhMessage{}, errDHConnectionClosed
+	}
+
+	return message, nil
+}
+
+// dhInterceptor sits between A and B and may read or replace every message.
+// fromA says which way the message is going. Messages in each direction are
+// intercepted in order, but the two directions run concurrently
+type dhInterceptor interface {
+	intercept(fromA bool, message dhMessage) dhMessage
+}
+
+// relayDH passes messages between the two connections through the interceptor,
+// which may be nil, until both sides hang up
+func relayDH(a dhConn, b dhConn, interceptor dhInterceptor) {
+	forward := func(from dhConn, to dhConn, fromA bool) {
+		for message := range from.receive {
+			if interceptor != nil {
+				message = interceptor.intercept(fromA, message)
+			}
+			to.send <- message
+		}
+		close(to.send)
+	}
+
+	go forward(a, b, true)
+	go forward(b, a, false)
+}
+
+// dhEncrypt encrypts a message with the key derived from the shared secret and
+// a random IV, in the protocol's cipher+IV format
+func dhEncrypt(secret *big.Int, message []byte) []byte {
+	iv := randomBytes(16)
+	return append(mustEncryptAESCBC(pks7Pad(message, 16), iv, dh.AESKey(secret)), iv...)
+}
+
+// dhDecrypt reverses dhEncrypt
+func dhDecrypt(secret *big.Int, data []byte) ([]byte, error) {
+	if len(data) < 16 {
+		return nil, ErrInvalidBlockLength
+	}
+
+	split := len(data) - 16
+	plaintext, err := decryptAESCBC(data[:split], data[split:], dh.AESKey(secret))
+	if err != nil {
+		return nil, err
+	}
+
+	return pks7Unpad(plaintext, 16)
+}
+
+// dhEchoOptions changes how the echo protocol runs. validate makes both parties
+// check the other's public value. negotiate makes A propose the group and wait
+// for B to acknowledge it before either sends a public value, so both use the
+// group as acknowledged
+type dhEchoOptions struct {
+	validate  bool
+	negotiate bool
+}
+
+// dhEchoInitiator is A in the echo protocol. It sends the group and its public
+// value, then sends each message and checks B echoes it back
+func dhEchoInitiator(conn dhConn, group *dh.Group, messages [][]byte, options dhEchoOptions) error {
+	defer close(conn.send)
+
+	if options.negotiate {
+		conn.send <- dhMessage{p: group.P, g: group.G}
+
+		ack, err := conn.read()
+		if err != nil {
+			return err
+		}
+		group, err = dhMessageGroup(ack)
+		if err != nil {
+			return err
+		}
+	}
+
+	key, err := group.GenerateKey()
+	if err != nil {
+		return err
+	}
+
+	hello := dhMessage{public: key.Public}
+	if !options.negotiate {
+		hello.p, hello.g = group.P, group.G
+	}
+	conn.send <- hello
+
+	reply, err := conn.read()
+	if err != nil {
+		return err
+	}
+	secret, err := dhSecret(key, reply.public, options.validate)
+	if err != nil {
+		return err
+	}
+
+	for _, message := range messages {
+		conn.send <- dhMessage{data: dhEncrypt(secret, message)}
+
+		reply, err := conn.read()
+		if err != nil {
+			return err
+		}
+
+		echo, err := dhDecrypt(secret, reply.data)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(echo, message) {
+			return errors.New("Echo doesn't match message")
+		}
+	}
+
+	return nil
+}
+
+// dhEchoResponder is B in the echo protocol. It replies to A's group and public
+// value with its own public value, then echoes every message until A hangs up
+func dhEchoResponder(conn dhConn, options dhEchoOptions) error {
+	defer close(conn.send)
+
+	hello, err := conn.read()
+	if err != nil {
+		return err
+	}
+	group, err := dhMessageGroup(hello)
+	if err != nil {
+		return err
+	}
+
+	if options.negotiate {
+		conn.send <- dhMessage{p: group.P, g: group.G}
+
+		hello, err = conn.read()
+		if err != nil {
+			return err
+		}
+	}
+
+	key, err := group.GenerateKey()
+	if err != nil {
+		return err
+	}
+	secret, err := dhSecret(key, hello.public, options.validate)
+	if err != nil {
+		return err
+	}
+	conn.send <- dhMessage{public: key.Public}
+
+	for message := range conn.receive {
+		plaintext, err := dhDecrypt(secret, message.data)
+		if err != nil {
+			return err
+		}
+		conn.send <- dhMessage{data: dhEncrypt(secret, plaintext)}
+	}
+
+	return nil
+}
+
+// dhMessageGroup returns the group sent in a hello or ack. Whatever is in the
+// message may have been put there by an interceptor, so the group is checked
+// before it's used
+func dhMessageGroup(message dhMessage) (*dh.Group, error) {
+	if err := (&dh.Group{P: message.p, G: message.g}).Validate(); err != nil {
+		return nil, err
+	}
+
+	return dh.NewSafePrimeGroup(message.p, message.g), nil
+}
+
+// dhSecret returns the shared secret with the peer's public value, validating it
+// first if asked. A missing public value is always an error
+func dhSecret(key *dh.KeyPair, peer *big.Int, validate bool) (*big.Int, error) {
+	if peer == nil {
+		return nil, errDHMissingPublic
+	}
+	if validate {
+		return key.SharedSecret(peer)
+	}
+
+	return key.UncheckedSharedSecret(peer), nil
+}
+
+// runDHEcho runs the echo protocol for the messages with A and B as goroutines
+// and the interceptor, if any, between them. It returns A's and B's errors
+func runDHEcho(group *dh.Group, messages [][]byte, interceptor dhInterceptor, options dhEchoOptions) (aErr error, bErr error) {
+	a, mitmA := dhPipe()
+	mitmB, b := dhPipe()
+	relayDH(mitmA, mitmB, interceptor)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		aErr = dhEchoInitiator(a, group, messages, options)
+	}()
+	go func() {
+		defer wg.Done()
+		bErr = dhEchoResponder(b, options)
+	}()
+	wg.Wait()
+
+	return aErr, bErr
+}
+
+// dhEchoReader keeps what a MITM reads of the echo protocol. B only ever echoes
+// A's messages back, so those are all there is to read
+type dhEchoReader struct {
+	plaintexts [][]byte
+	errs       []error
+}
+
+// read decrypts a data message from A with the secret, keeping the plaintext or
+// the reason it couldn't be read. Messages from B are skipped
+func (r *dhEchoReader) read(fromA bool, data []byte, secret func() (*big.Int, error)) {
+	if !fromA {
+		return
+	}
+
+	key, err := secret()
+	if err != nil {
+		r.errs = append(r.errs, err)
+		return
+	}
+
+	plaintext, err := dhDecrypt(key, data)
+	if err != nil {
+		r.errs = append(r.errs, err)
+		return
+	}
+
+	r.plaintexts = append(r.plaintexts, plaintext)
+}
+
+// dhKeyFixingMITM replaces both public values with p, which makes both shared
+// secrets p^x mod p = 0. It then reads the conversation while passing it on
+// untouched
+type dhKeyFixingMITM struct {
+	dhEchoReader
+
+	mu sync.Mutex
+	p  *big.Int
+}
+
+func (m *dhKeyFixingMITM) intercept(fromA bool, message dhMessage) dhMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if message.p != nil {
+		m.p = message.p
+	}
+	if message.public != nil {
+		message.public = m.p
+		return message
+	}
+
+	m.read(fromA, message.data, func() (*big.Int, error) { return big.NewInt(0), nil })
+
+	return message
+}
+
+// dhMaliciousGMITM replaces g while the group is negotiated so that both parties
+// end up with a shared secret it can predict, then reads their traffic. fakeG
+// picks the replacement for the given p
+type dhMaliciousGMITM struct {
+	dhEchoReader
+	fakeG func(p *big.Int) *big.Int
+
+	mu      sync.Mutex
+	p       *big.Int
+	g       *big.Int
+	publics []*big.Int
+}
+
+func (m *dhMaliciousGMITM) intercept(fromA bool, message dhMessage) dhMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch {
+	case message.g != nil:
+		m.p = message.p
+		m.g = m.fakeG(message.p)
+		message.g = m.g
+
+	case message.public != nil:
+		m.publics = append(m.publics, message.public)
+
+	default:
+		m.read(fromA, message.data, func() (*big.Int, error) { return maliciousGSecret(m.p, m.g, m.publics) })
+	}
+
+	return message
+}
+
+// maliciousGSecret predicts the shared secret when both parties use g with p,
+// given their public values. With g = 1 every public value and the secret are 1,
+// and with g = p they're all 0. With g = p-1 a public value is p-1 if its private
+// exponent is odd and 1 if it's even, so the secret is p-1 when both public
+// values are p-1 and 1 otherwise
+func maliciousGSecret(p *big.Int, g *big.Int, publics []*big.Int) (*big.Int, error) {
+	pMinusOne := new(big.Int).Sub(p, big.NewInt(1))
+
+	switch {
+	case g.Cmp(big.NewInt(1)) == 0:
+		return big.NewInt(1), nil
+	case g.Cmp(p) == 0:
+		return big.NewInt(0), nil
+	case g.Cmp(pMinusOne) == 0:
+		if len(publics) != 2 {
+			return nil, errors.New("Both public values are needed to predict the secret")
+		}
+		if publics[0].Cmp(pMinusOne) == 0 && publics[1].Cmp(pMinusOne) == 0 {
+			return pMinusOne, nil
+		}
+		return big.NewInt(1), nil
+	}
+
+	return nil, errors.New("Shared secret for g isn't predictable")
+}
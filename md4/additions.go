@@ -0,0 +1,25 @@
+package md4
+
+import (
+	"hash"
+)
+
+// Normally when creating or reseting the hash state we use the builtin
+// magic numbers. Instead we want to be able to set these to arbitrary values
+func (d *digest) ResetToGivenRegisters(registers [4]uint32) {
+	for i := 0; i < 4; i++ {
+		d.h[i] = registers[i]
+	}
+
+	d.nx = 0
+	d.len = 0
+}
+
+// NewWithGivenRegisters returns a new hash.Hash computing the MD4 checksum
+// starting from the given registers, and padding as if size bytes were written.
+func NewWithGivenRegisters(registers [4]uint32, size uint64) hash.Hash {
+	d := new(digest)
+	d.FixedLength = size
+	d.ResetToGivenRegisters(registers)
+	return d
+}
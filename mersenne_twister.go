@@ -1,87 +1,634 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const mersenneTwisterStateLength = 624
 
-type mersenneTwister struct {
-	state []int
-	index int
+// TwisterParams describes a Mersenne Twister variant using the usual names: a
+// state of N words of W bits, middle word offset M, separation point R, twist
+// matrix A, tempering shifts and masks U, D, S, B, T, C, L and the
+// initialization multiplier F. ArrayF1 and ArrayF2 are the multipliers used by
+// init_by_array; variants without them can't be seeded from an array
+type TwisterParams struct {
+	W, N, M, R uint
+	A          uint64
+	U          uint
+	D          uint64
+	S          uint
+	B          uint64
+	T          uint
+	C          uint64
+	L          uint
+	F          uint64
+
+	ArrayF1, ArrayF2 uint64
 }
 
-func newMersenneTwister(seed int) *mersenneTwister {
-	mt := &mersenneTwister{state: make([]int, 0, mersenneTwisterStateLength)}
+var (
+	// MT19937Params is the 32-bit Mersenne Twister from mt19937ar.c
+	MT19937Params = TwisterParams{
+		W: 32, N: 624, M: 397, R: 31,
+		A: 0x9908b0df,
+		U: 11, D: 0xffffffff,
+		S: 7, B: 0x9d2c5680,
+		T: 15, C: 0xefc60000,
+		L: 18,
+		F: 1812433253,
 
-	mt.state = append(mt.state, seed)
-	for i := 1; i < mersenneTwisterStateLength; i++ {
-		prev := mt.state[i-1]
-		mt.state = append(mt.state, int(int32(0x6c078965*(prev^(prev>>30))+i))&0x7fffffff)
+		ArrayF1: 1664525, ArrayF2: 1566083941,
+	}
+
+	// MT64Params is the 64-bit Mersenne Twister from mt19937-64.c
+	MT64Params = TwisterParams{
+		W: 64, N: 312, M: 156, R: 31,
+		A: 0xb5026f5aa96619e9,
+		U: 29, D: 0x5555555555555555,
+		S: 17, B: 0x71d67fffeda60000,
+		T: 37, C: 0xfff7eee000000000,
+		L: 43,
+		F: 6364136223846793005,
+
+		ArrayF1: 3935559000370003845, ArrayF2: 2862933555777941757,
+	}
+)
+
+// mask returns the value with only the low W bits kept
+func (p *TwisterParams) mask(value uint64) uint64 {
+	if p.W >= 64 {
+		return value
+	}
+	return value & (1<<p.W - 1)
+}
+
+// lowerMask covers the R low bits of a word, which come from the next word when
+// twisting
+func (p *TwisterParams) lowerMask() uint64 {
+	return 1<<p.R - 1
+}
+
+// temper scrambles a state word into an output
+func (p *TwisterParams) temper(y uint64) uint64 {
+	y ^= (y >> p.U) & p.D // 1st step
+	y ^= (y << p.S) & p.B // 2nd step
+	y ^= (y << p.T) & p.C // 3rd step
+	y ^= y >> p.L         // 4th step
+	return p.mask(y)
+}
+
+// untemper recovers the state word behind an output. Each step only mixes in
+// bits from a shifted copy of itself, so applying it again enough times to cover
+// the whole word undoes it
+func (p *TwisterParams) untemper(y uint64) uint64 {
+	y = p.unshiftRight(y, p.L, p.mask(^uint64(0))) // Undo 4th step
+	y = p.unshiftLeft(y, p.T, p.C)                 // Undo 3rd step
+	y = p.unshiftLeft(y, p.S, p.B)                 // Undo 2nd step
+	y = p.unshiftRight(y, p.U, p.D)                // Undo 1st step
+	return y
+}
+
+func (p *TwisterParams) unshiftRight(y uint64, shift uint, mask uint64) uint64 {
+	x := y
+	for covered := uint(0); covered < p.W; covered += shift {
+		x = y ^ ((x >> shift) & mask)
+	}
+	return p.mask(x)
+}
+
+func (p *TwisterParams) unshiftLeft(y uint64, shift uint, mask uint64) uint64 {
+	x := y
+	for covered := uint(0); covered < p.W; covered += shift {
+		x = p.mask(y ^ ((x << shift) & mask))
 	}
+	return x
+}
 
+// Twister is a Mersenne Twister for any TwisterParams. It implements
+// math/rand.Source and math/rand.Source64. It isn't safe for concurrent use
+type Twister struct {
+	params TwisterParams
+	state  []uint64
+	index  int
+}
+
+// NewTwister returns a twister seeded like init_genrand
+func NewTwister(params TwisterParams, seed uint64) *Twister {
+	mt := &Twister{params: params, state: make([]uint64, params.N)}
+	mt.seed(seed)
 	return mt
 }
 
-func (mt *mersenneTwister) next() int {
-	if mt.index == 0 {
-		for i := 0; i < mersenneTwisterStateLength; i++ {
-			next := mt.state[(i+1)%mersenneTwisterStateLength]
-			y := (mt.state[i] & 0x80000000) + (next & 0x7fffffff)
-			mt.state[i] = mt.state[(i+397)%mersenneTwisterStateLength] ^ (y >> 1)
-			if (y % 2) != 0 {
-				mt.state[i] = mt.state[i] ^ 0x9908b0df
-			}
+// NewTwisterByArray returns a twister seeded like init_by_array, which uses
+// every bit of a key of any length
+func NewTwisterByArray(params TwisterParams, key []uint64) (*Twister, error) {
+	if params.ArrayF1 == 0 || params.ArrayF2 == 0 {
+		return nil, errors.New("Twister parameters don't support seeding by array")
+	}
+	if len(key) == 0 {
+		return nil, errors.New("Twister key must not be empty")
+	}
+
+	mt := &Twister{params: params, state: make([]uint64, params.N)}
+	mt.seedByArray(key)
+	return mt, nil
+}
+
+// NewTwisterFromState returns a twister which continues from the given state
+// words and index, such as ones recovered from its output
+func NewTwisterFromState(params TwisterParams, state []uint64, index int) (*Twister, error) {
+	if uint(len(state)) != params.N {
+		return nil, fmt.Errorf("state must be %d words", params.N)
+	}
+	if index < 0 || index > len(state) {
+		return nil, fmt.Errorf("index %d out of range", index)
+	}
+
+	return &Twister{params: params, state: append([]uint64{}, state...), index: index}, nil
+}
+
+func (mt *Twister) seed(seed uint64) {
+	p := &mt.params
+
+	mt.state[0] = p.mask(seed)
+	for i := 1; i < len(mt.state); i++ {
+		prev := mt.state[i-1]
+		mt.state[i] = p.mask(p.F*(prev^(prev>>(p.W-2))) + uint64(i))
+	}
+
+	// Twist before the first output
+	mt.index = len(mt.state)
+}
+
+func (mt *Twister) seedByArray(key []uint64) {
+	p := &mt.params
+	n := len(mt.state)
+
+	mt.seed(19650218)
+
+	i, j := 1, 0
+	k := len(key)
+	if k < n {
+		k = n
+	}
+
+	for ; k > 0; k-- {
+		prev := mt.state[i-1]
+		mt.state[i] = p.mask((mt.state[i] ^ ((prev ^ (prev >> (p.W - 2))) * p.ArrayF1)) + key[j] + uint64(j))
+
+		i++
+		if i >= n {
+			mt.state[0] = mt.state[n-1]
+			i = 1
+		}
+
+		j++
+		if j >= len(key) {
+			j = 0
 		}
 	}
 
-	y := temperMersenneTwisterNumber(mt.state[mt.index])
-	mt.index = (mt.index + 1) % mersenneTwisterStateLength
+	for k = n - 1; k > 0; k-- {
+		prev := mt.state[i-1]
+		mt.state[i] = p.mask((mt.state[i] ^ ((prev ^ (prev >> (p.W - 2))) * p.ArrayF2)) - uint64(i))
 
-	return y
+		i++
+		if i >= n {
+			mt.state[0] = mt.state[n-1]
+			i = 1
+		}
+	}
+
+	// MSB is 1, assuring a non-zero initial state
+	mt.state[0] = 1 << (p.W - 1)
 }
 
-func temperMersenneTwisterNumber(y int) int {
-	y ^= y >> 11                // 1st step
-	y ^= (y << 7) & 0x9d2c5680  // 2nd step
-	y ^= (y << 15) & 0xefc60000 // 3rd step
-	y ^= y >> 18                // 4th step
+// twist generates the next N state words
+func (mt *Twister) twist() {
+	p := &mt.params
+	n := len(mt.state)
+	lower := p.lowerMask()
+	upper := p.mask(^lower)
+
+	for i := 0; i < n; i++ {
+		y := (mt.state[i] & upper) | (mt.state[(i+1)%n] & lower)
+
+		mt.state[i] = mt.state[(i+int(p.M))%n] ^ (y >> 1)
+		if y&1 != 0 {
+			mt.state[i] ^= p.A
+		}
+	}
+
+	mt.index = 0
+}
+
+// next returns the next W-bit output
+func (mt *Twister) next() uint64 {
+	if mt.index >= len(mt.state) {
+		mt.twist()
+	}
+
+	y := mt.params.temper(mt.state[mt.index])
+	mt.index++
+
 	return y
 }
 
-func untemperMersenneTwisterNumber(y int) int {
-	// Undo 4th step
-	y ^= y >> 18
+// Uint64 returns 64 bits of output. Variants with smaller words join as many
+// outputs as it takes, the first one in the high bits
+func (mt *Twister) Uint64() uint64 {
+	if mt.params.W >= 64 {
+		return mt.next()
+	}
 
-	// Undo 3rd step
-	y ^= (y << 15) & 0xefc60000
+	var value uint64
+	for bits := uint(0); bits < 64; bits += mt.params.W {
+		value = value<<mt.params.W | mt.next()
+	}
+	return value
+}
 
-	// Undo 2nd step
-	x := y
-	x = y ^ (x<<7)&0x9d2c5680
-	x = y ^ (x<<7)&0x9d2c5680
-	x = y ^ (x<<7)&0x9d2c5680
-	x = y ^ (x<<7)&0x9d2c5680
+// Int63 returns a non-negative int64 from Uint64
+func (mt *Twister) Int63() int64 {
+	return int64(mt.Uint64() >> 1)
+}
+
+// Seed reseeds the twister. Seeds which fit in a word are used like
+// init_genrand so they match the reference; larger ones are split into words for
+// init_by_array so no bits are lost
+func (mt *Twister) Seed(seed int64) {
+	if (seed >= 0 && uint64(seed) == mt.params.mask(uint64(seed))) || mt.params.ArrayF1 == 0 || mt.params.ArrayF2 == 0 {
+		mt.seed(uint64(seed))
+		return
+	}
+
+	key := []uint64{}
+	for rest := uint64(seed); rest != 0; rest >>= mt.params.W {
+		key = append(key, mt.params.mask(rest))
+	}
+	mt.seedByArray(key)
+}
+
+// State returns a copy of the state words and the index of the next one to be
+// output
+func (mt *Twister) State() ([]uint64, int) {
+	return append([]uint64{}, mt.state...), mt.index
+}
+
+// wordSize is the number of bytes each state word is serialized as
+func (mt *Twister) wordSize() int {
+	return int(mt.params.W+7) / 8
+}
+
+// MarshalBinary serializes the state words and index, all big endian. Words take
+// as few bytes as W allows and the index takes 4
+func (mt *Twister) MarshalBinary() ([]byte, error) {
+	size := mt.wordSize()
+	data := make([]byte, len(mt.state)*size+4)
+
+	word := make([]byte, 8)
+	for i, value := range mt.state {
+		binary.BigEndian.PutUint64(word, value)
+		copy(data[i*size:], word[8-size:])
+	}
+	binary.BigEndian.PutUint32(data[len(mt.state)*size:], uint32(mt.index))
+
+	return data, nil
+}
+
+// UnmarshalBinary restores a twister serialized with MarshalBinary. The twister
+// must already have the right parameters, e.g. from NewTwister
+func (mt *Twister) UnmarshalBinary(data []byte) error {
+	size := mt.wordSize()
+	n := int(mt.params.N)
+	if len(data) != n*size+4 {
+		return fmt.Errorf("%w: twister state must be %d bytes", ErrInvalidEncoding, n*size+4)
+	}
+
+	state := make([]uint64, n)
+	word := make([]byte, 8)
+	for i := range state {
+		copy(word[8-size:], data[i*size:(i+1)*size])
+		state[i] = binary.BigEndian.Uint64(word)
+	}
+
+	index := binary.BigEndian.Uint32(data[n*size:])
+	if index > uint32(n) {
+		return fmt.Errorf("%w: twister index %d out of range", ErrInvalidEncoding, index)
+	}
+
+	mt.state = state
+	mt.index = int(index)
+	return nil
+}
 
-	// Undo 1st step
-	z := x
-	z = x ^ (z >> 11)
-	z = x ^ (z >> 11)
+// MT19937 is the 32-bit Mersenne Twister as defined by the reference
+// mt19937ar.c. It implements math/rand.Source and math/rand.Source64 so it can
+// back a *rand.Rand. It isn't safe for concurrent use
+type MT19937 struct {
+	twister Twister
+}
+
+// NewMT19937 returns a twister seeded like init_genrand in mt19937ar.c
+func NewMT19937(seed uint32) *MT19937 {
+	return &MT19937{twister: *NewTwister(MT19937Params, uint64(seed))}
+}
+
+// NewMT19937ByArray returns a twister seeded like init_by_array in mt19937ar.c,
+// which uses every bit of a key of any length
+func NewMT19937ByArray(key []uint32) *MT19937 {
+	mt := &MT19937{twister: Twister{params: MT19937Params, state: make([]uint64, mersenneTwisterStateLength)}}
+
+	wideKey := make([]uint64, len(key))
+	for i, word := range key {
+		wideKey[i] = uint64(word)
+	}
+	mt.twister.seedByArray(wideKey)
+
+	return mt
+}
+
+// NewMT19937FromState returns a twister which continues from the given state
+// words and index, such as ones recovered from its output
+func NewMT19937FromState(state [mersenneTwisterStateLength]uint32, index int) (*MT19937, error) {
+	wideState := make([]uint64, mersenneTwisterStateLength)
+	for i, word := range state {
+		wideState[i] = uint64(word)
+	}
+
+	twister, err := NewTwisterFromState(MT19937Params, wideState, index)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MT19937{twister: *twister}, nil
+}
+
+// Uint32 returns the next output, like genrand_int32 in mt19937ar.c
+func (mt *MT19937) Uint32() uint32 {
+	return uint32(mt.twister.next())
+}
+
+// Uint64 returns two outputs joined together, the first one in the high bits
+func (mt *MT19937) Uint64() uint64 {
+	return mt.twister.Uint64()
+}
+
+// Int63 returns a non-negative int64 made of two outputs
+func (mt *MT19937) Int63() int64 {
+	return mt.twister.Int63()
+}
 
-	return z
+// Seed reseeds the twister. Seeds which fit in 32 bits are used like
+// init_genrand so they match the reference; larger ones are split into two
+// words for init_by_array so no bits are lost
+func (mt *MT19937) Seed(seed int64) {
+	mt.twister.Seed(seed)
 }
 
-func crackMersenneTwisterSeed(mt *mersenneTwister) (int, error) {
-	target := mt.next()
+// State returns a copy of the state words and the index of the next one to be
+// output
+func (mt *MT19937) State() ([mersenneTwisterStateLength]uint32, int) {
+	var state [mersenneTwisterStateLength]uint32
+	for i, word := range mt.twister.state {
+		state[i] = uint32(word)
+	}
+
+	return state, mt.twister.index
+}
+
+// MarshalBinary serializes the 624 state words followed by the index, all big
+// endian
+func (mt *MT19937) MarshalBinary() ([]byte, error) {
+	return mt.twister.MarshalBinary()
+}
+
+// UnmarshalBinary restores a twister serialized with MarshalBinary
+func (mt *MT19937) UnmarshalBinary(data []byte) error {
+	mt.twister.params = MT19937Params
+	return mt.twister.UnmarshalBinary(data)
+}
+
+func temperMersenneTwisterNumber(y uint32) uint32 {
+	return uint32(MT19937Params.temper(uint64(y)))
+}
+
+func untemperMersenneTwisterNumber(y uint32) uint32 {
+	return uint32(MT19937Params.untemper(uint64(y)))
+}
+
+// mt19937Output is an output seen at a known offset, i.e. after that many
+// outputs of the twister were used up
+type mt19937Output struct {
+	offset int
+	value  uint32
+}
+
+// seedRange is an inclusive range of seeds
+type seedRange struct {
+	first uint32
+	last  uint32
+}
+
+// timeSeedRange returns the seeds for the timestamps in the window up to now.
+// A window reaching back past the epoch starts at seed 0
+func timeSeedRange(now time.Time, window time.Duration) seedRange {
+	last := uint32(now.Unix())
+	first := last - uint32(window/time.Second)
+	if first > last {
+		first = 0
+	}
+
+	return seedRange{first: first, last: last}
+}
+
+// mt19937SeedSearch looks for the seeds of an MT19937 seeded with a timestamp.
+// By default seeds from the window before the clock are tried; setting seeds
+// searches that range instead. A zero window means 5 minutes, a nil clock means
+// time.Now and 0 workers means one per CPU
+type mt19937SeedSearch struct {
+	clock   func() time.Time
+	window  time.Duration
+	seeds   *seedRange
+	workers int
+}
+
+// bounds returns the range of seeds to try
+func (s *mt19937SeedSearch) bounds() seedRange {
+	if s.seeds != nil {
+		return *s.seeds
+	}
+
+	clock := s.clock
+	if clock == nil {
+		clock = time.Now
+	}
+	window := s.window
+	if window == 0 {
+		window = 5 * time.Minute
+	}
 
-	currentTimestamp := int(time.Now().Unix())
-	for i := currentTimestamp; i >= currentTimestamp-300; i-- {
-		testMt := newMersenneTwister(i)
-		if testMt.next() == target {
-			return i, nil
+	return timeSeedRange(clock(), window)
+}
+
+// crack returns every seed in range which produces all of the observed outputs,
+// in ascending order
+func (s *mt19937SeedSearch) crack(observations []mt19937Output) ([]uint32, error) {
+	if len(observations) == 0 {
+		return nil, errors.New("No outputs to match seeds against")
+	}
+
+	sorted := append([]mt19937Output{}, observations...)
+	sort.Slice(sorted, func(a, b int) bool { return sorted[a].offset < sorted[b].offset })
+	if sorted[0].offset < 0 {
+		return nil, fmt.Errorf("offset %d out of range", sorted[0].offset)
+	}
+
+	seeds := s.bounds()
+	candidates := searchAllSeeds(seeds.first, seeds.last, s.workers, func(seed uint32) bool {
+		mt := NewMT19937(seed)
+
+		var output uint32
+		produced := 0
+		for _, observation := range sorted {
+			for ; produced <= observation.offset; produced++ {
+				output = mt.Uint32()
+			}
+
+			if output != observation.value {
+				return false
+			}
 		}
+
+		return true
+	})
+
+	if len(candidates) == 0 {
+		return nil, errors.New("Could not determine seed")
+	}
+
+	return candidates, nil
+}
+
+// crackMersenneTwisterSeed finds the seed of a twister seeded with the time in
+// the last 5 minutes from its next output
+func crackMersenneTwisterSeed(mt *MT19937) (uint32, error) {
+	search := &mt19937SeedSearch{}
+	candidates, err := search.crack([]mt19937Output{{offset: 0, value: mt.Uint32()}})
+	if err != nil {
+		return 0, err
+	}
+
+	return candidates[len(candidates)-1], nil
+}
+
+// searchSeeds calls match for every seed from first to last inclusive, spread
+// over the given number of workers (or one per CPU if 0), and returns the first
+// seed found to match. The search stops early once a match is found
+func searchSeeds(first uint32, last uint32, workers int, match func(seed uint32) bool) (uint32, bool) {
+	seeds := scanSeeds(first, last, workers, match, true)
+	if len(seeds) == 0 {
+		return 0, false
+	}
+
+	return seeds[0], true
+}
+
+// searchAllSeeds is searchSeeds but keeps going to return every matching seed,
+// in ascending order
+func searchAllSeeds(first uint32, last uint32, workers int, match func(seed uint32) bool) []uint32 {
+	seeds := scanSeeds(first, last, workers, match, false)
+	sort.Slice(seeds, func(a, b int) bool { return seeds[a] < seeds[b] })
+
+	return seeds
+}
+
+func scanSeeds(first uint32, last uint32, workers int, match func(seed uint32) bool, stopAtFirst bool) []uint32 {
+	if workers < 1 {
+		workers = runtime.NumCPU()
 	}
 
-	return 0, errors.New("Could not determine seed")
+	const chunk = 256
+
+	var (
+		next  = uint64(first)
+		stop  int32
+		mu    sync.Mutex
+		seeds []uint32
+		wg    sync.WaitGroup
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for atomic.LoadInt32(&stop) == 0 {
+				start := atomic.AddUint64(&next, chunk) - chunk
+				if start > uint64(last) {
+					return
+				}
+
+				end := start + chunk - 1
+				if end > uint64(last) {
+					end = uint64(last)
+				}
+
+				for candidate := start; candidate <= end; candidate++ {
+					if !match(uint32(candidate)) {
+						continue
+					}
+
+					mu.Lock()
+					seeds = append(seeds, uint32(candidate))
+					mu.Unlock()
+
+					if stopAtFirst {
+						atomic.StoreInt32(&stop, 1)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return seeds
+}
+
+// crackMT19937StreamSeed recovers the 16-bit seed of a calculateMT19937WithSeed
+// cipher whose plaintext is known to end with knownSuffix
+func crackMT19937StreamSeed(cipher []byte, knownSuffix []byte, workers int) (uint16, error) {
+	if len(knownSuffix) > len(cipher) {
+		return 0, errors.New("Known plaintext is longer than the cipher")
+	}
+
+	seed, ok := searchSeeds(0, 0xffff, workers, func(seed uint32) bool {
+		plaintext := calculateMT19937WithSeed(cipher, seed)
+		return bytes.HasSuffix(plaintext, knownSuffix)
+	})
+	if !ok {
+		return 0, errors.New("Could not determine seed")
+	}
+
+	return uint16(seed), nil
+}
+
+// isMT19937ResetToken reports whether the token is the start of the output of an
+// MT19937 seeded with a time in the window before now, as made by
+// mt19937ResetToken, and if so the seed
+func isMT19937ResetToken(token []byte, now time.Time, window time.Duration, workers int) (uint32, bool) {
+	seeds := timeSeedRange(now, window)
+
+	return searchSeeds(seeds.first, seeds.last, workers, func(seed uint32) bool {
+		return bytes.Equal(mt19937ResetToken(time.Unix(int64(seed), 0)), token)
+	})
 }
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/subtle"
+)
+
+// Padding is a scheme for padding messages out to a whole number of blocks
+type Padding interface {
+	// Pad returns a padded copy of data. The input is never modified
+	Pad(data []byte, blockSize int) []byte
+
+	// Unpad returns a copy of data with its padding removed, or ErrInvalidPadding
+	// if data isn't correctly padded for the block size
+	Unpad(data []byte, blockSize int) ([]byte, error)
+
+	// Example returns a valid run of padding of the given length. Padding oracle
+	// attacks force the end of a block to this to learn what it decrypts to
+	Example(length int) []byte
+}
+
+// The supported padding schemes
+var (
+	PKCS7Padding    Padding = pkcs7Padding{}
+	ANSIX923Padding Padding = ansiX923Padding{}
+	ISO7816Padding  Padding = iso7816Padding{}
+	ISO10126Padding Padding = iso10126Padding{}
+	ZeroPadding     Padding = zeroPadding{}
+)
+
+// paddingLength returns how many bytes of padding data needs. Always at least 1
+func paddingLength(data []byte, blockSize int) int {
+	return blockSize - (len(data) % blockSize)
+}
+
+// appendPadding returns a copy of data with the padding appended
+func appendPadding(data []byte, padding []byte) []byte {
+	paddedData := make([]byte, len(data), len(data)+len(padding))
+	copy(paddedData, data)
+	return append(paddedData, padding...)
+}
+
+// trimPadding returns a copy of data without its last padLength bytes
+func trimPadding(data []byte, padLength int) []byte {
+	return copyBytes(data[:len(data)-padLength])
+}
+
+// isWholeBlocks checks that data is made of one or more whole blocks
+func isWholeBlocks(data []byte, blockSize int) bool {
+	return len(data) > 0 && len(data)%blockSize == 0
+}
+
+//
+// PKCS#7
+//
+
+type pkcs7Padding struct{}
+
+func (pkcs7Padding) Pad(data []byte, blockSize int) []byte { return pks7Pad(data, blockSize) }
+
+func (pkcs7Padding) Unpad(data []byte, blockSize int) ([]byte, error) {
+	return pks7Unpad(data, blockSize)
+}
+
+func (pkcs7Padding) Example(length int) []byte {
+	padding := make([]byte, length)
+	for i := range padding {
+		padding[i] = byte(length)
+	}
+	return padding
+}
+
+// pks7Pad returns a padded copy of data. The input is never modified
+func pks7Pad(data []byte, blockSize int) []byte {
+	return appendPadding(data, PKCS7Padding.Example(paddingLength(data, blockSize)))
+}
+
+// pks7Unpad returns a copy of data with its padding removed, or ErrInvalidPadding
+// if data isn't correctly padded for the block size
+func pks7Unpad(data []byte, blockSize int) ([]byte, error) {
+	if !isPks7Padded(data, blockSize) {
+		return nil, ErrInvalidPadding
+	}
+
+	return trimPadding(data, int(data[len(data)-1])), nil
+}
+
+// isPks7Padded checks that data is whole blocks ending in valid padding. The
+// padding can be at most one block long
+func isPks7Padded(data []byte, blockSize int) bool {
+	dataLength := len(data)
+	if dataLength == 0 || dataLength%blockSize != 0 {
+		return false
+	}
+
+	padLength := int(data[dataLength-1])
+
+	if padLength == 0 || padLength > blockSize {
+		return false
+	}
+
+	for i := 0; i < padLength; i++ {
+		if int(data[dataLength-i-1]) != padLength {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isPks7PaddedConstantTime is isPks7Padded but takes the same time to check any
+// padding for a given data length and block size. Unlike isPks7Padded, which
+// bails out at the first bad byte, it doesn't leak where the padding went wrong
+func isPks7PaddedConstantTime(data []byte, blockSize int) bool {
+	dataLength := len(data)
+	if dataLength == 0 || dataLength%blockSize != 0 || blockSize > 255 {
+		return false
+	}
+
+	padLength := data[dataLength-1]
+	valid := subtle.ConstantTimeLessOrEq(1, int(padLength)) &
+		subtle.ConstantTimeLessOrEq(int(padLength), blockSize)
+
+	// Look at every byte of the last block, only counting those inside the padding
+	for i := 0; i < blockSize; i++ {
+		inPadding := subtle.ConstantTimeLessOrEq(i+1, int(padLength))
+		matches := subtle.ConstantTimeByteEq(data[dataLength-1-i], padLength)
+		valid &= (1 ^ inPadding) | matches
+	}
+
+	return valid == 1
+}
+
+// validatePks7Padded returns ErrInvalidPadding if data isn't pks7 padded
+func validatePks7Padded(data []byte, blockSize int) error {
+	if !isPks7Padded(data, blockSize) {
+		return ErrInvalidPadding
+	}
+
+	return nil
+}
+
+// mustValidatePks7Padded is like validatePks7Padded but panics on error
+func mustValidatePks7Padded(data []byte, blockSize int) {
+	if err := validatePks7Padded(data, blockSize); err != nil {
+		panic(err)
+	}
+}
+
+//
+// ANSI X.923: zeros followed by the padding length
+//
+
+type ansiX923Padding struct{}
+
+func (p ansiX923Padding) Pad(data []byte, blockSize int) []byte {
+	return appendPadding(data, p.Example(paddingLength(data, blockSize)))
+}
+
+func (ansiX923Padding) Unpad(data []byte, blockSize int) ([]byte, error) {
+	if !isWholeBlocks(data, blockSize) {
+		return nil, ErrInvalidPadding
+	}
+
+	dataLength := len(data)
+	padLength := int(data[dataLength-1])
+	if padLength == 0 || padLength > blockSize {
+		return nil, ErrInvalidPadding
+	}
+
+	for i := 2; i <= padLength; i++ {
+		if data[dataLength-i] != 0 {
+			return nil, ErrInvalidPadding
+		}
+	}
+
+	return trimPadding(data, padLength), nil
+}
+
+func (ansiX923Padding) Example(length int) []byte {
+	padding := make([]byte, length)
+	padding[length-1] = byte(length)
+	return padding
+}
+
+//
+// ISO/IEC 7816-4: a single 0x80 byte followed by zeros
+//
+
+type iso7816Padding struct{}
+
+func (p iso7816Padding) Pad(data []byte, blockSize int) []byte {
+	return appendPadding(data, p.Example(paddingLength(data, blockSize)))
+}
+
+func (iso7816Padding) Unpad(data []byte, blockSize int) ([]byte, error) {
+	if !isWholeBlocks(data, blockSize) {
+		return nil, ErrInvalidPadding
+	}
+
+	// Skip back over the zeros, which can't fill the whole block
+	dataLength := len(data)
+	for padLength := 1; padLength <= blockSize; padLength++ {
+		b := data[dataLength-padLength]
+		if b == 0x80 {
+			return trimPadding(data, padLength), nil
+		}
+		if b != 0x00 {
+			break
+		}
+	}
+
+	return nil, ErrInvalidPadding
+}
+
+func (iso7816Padding) Example(length int) []byte {
+	padding := make([]byte, length)
+	padding[0] = 0x80
+	return padding
+}
+
+//
+// ISO 10126: random bytes followed by the padding length
+//
+
+type iso10126Padding struct{}
+
+func (iso10126Padding) Pad(data []byte, blockSize int) []byte {
+	padLength := paddingLength(data, blockSize)
+	padding := randomBytes(padLength)
+	padding[padLength-1] = byte(padLength)
+	return appendPadding(data, padding)
+}
+
+func (iso10126Padding) Unpad(data []byte, blockSize int) ([]byte, error) {
+	if !isWholeBlocks(data, blockSize) {
+		return nil, ErrInvalidPadding
+	}
+
+	padLength := int(data[len(data)-1])
+	if padLength == 0 || padLength > blockSize {
+		return nil, ErrInvalidPadding
+	}
+
+	return trimPadding(data, padLength), nil
+}
+
+// Example uses zeros for the random bytes since any value is valid
+func (iso10126Padding) Example(length int) []byte {
+	return ansiX923Padding{}.Example(length)
+}
+
+//
+// Zero padding: zeros, only added when data isn't already whole blocks. It
+// can't be removed reliably from data which ends in zeros, and nothing is ever
+// invalid so it doesn't leak anything to a padding oracle either
+//
+
+type zeroPadding struct{}
+
+func (zeroPadding) Pad(data []byte, blockSize int) []byte {
+	if len(data)%blockSize == 0 {
+		return copyBytes(data)
+	}
+	return appendPadding(data, make([]byte, paddingLength(data, blockSize)))
+}
+
+func (zeroPadding) Unpad(data []byte, blockSize int) ([]byte, error) {
+	if len(data)%blockSize != 0 {
+		return nil, ErrInvalidPadding
+	}
+
+	padLength := 0
+	for padLength < len(data) && padLength < blockSize && data[len(data)-1-padLength] == 0 {
+		padLength++
+	}
+
+	return trimPadding(data, padLength), nil
+}
+
+func (zeroPadding) Example(length int) []byte {
+	return make([]byte, length)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+)
+
+// errPaddingOracleAmbiguous is returned when the oracle accepts more than one
+// value for a byte, so its answers say nothing about that byte
+var errPaddingOracleAmbiguous = errors.New("Padding oracle accepts more than one cPrime byte")
+
+// paddingOracle reports whether the ciphertext decrypts with valid padding
+// under the given IV. An error means the oracle couldn't answer at all
+type paddingOracle func(iv []byte, ciphertext []byte) (bool, error)
+
+// paddingOracleAttack decrypts and encrypts CBC messages using nothing but a
+// padding oracle. Blocks are independent of each other so up to concurrency of
+// them are worked on at once; 0 or 1 means one at a time. Queries are recorded
+// with the meter, which may be nil.
+//
+// The scheme has to constrain every byte of its padding, like PKCS#7, ANSI X.923
+// and ISO/IEC 7816-4 do, since each byte is found by making it part of a padding
+// the oracle checks. An ISO 10126 oracle only checks the last byte is a valid
+// length, which leaks that byte of each block and nothing else: CBC XORs every
+// byte with the same position of the previous block, so there's no moving an
+// earlier byte into the last place. Zero padding leaks nothing at all. Both give
+// errPaddingOracleAmbiguous
+type paddingOracleAttack struct {
+	oracle      paddingOracle
+	padding     Padding
+	blockSize   int
+	concurrency int
+	meter       *oracleMeter
+}
+
+// crackCBCWithPaddingOracle decrypts the cipher using only the padding oracle.
+// See paddingOracleAttack for the options
+func crackCBCWithPaddingOracle(oracle paddingOracle, cipher []byte, iv []byte, padding Padding, meter *oracleMeter) ([]byte, error) {
+	attack := &paddingOracleAttack{oracle: oracle, padding: padding, blockSize: len(iv), meter: meter}
+	return attack.decrypt(cipher, iv)
+}
+
+// forgeCBCWithPaddingOracle returns an IV and cipher which decrypt to the
+// plaintext under the oracle's key, padded with the given scheme. The key itself
+// is never needed; see paddingOracleAttack.encrypt
+func forgeCBCWithPaddingOracle(oracle paddingOracle, plaintext []byte, blockSize int, padding Padding, meter *oracleMeter) ([]byte, []byte, error) {
+	attack := &paddingOracleAttack{oracle: oracle, padding: padding, blockSize: blockSize, meter: meter}
+	return attack.encrypt(plaintext)
+}
+
+// decrypt returns the plaintext for the cipher, including its padding
+func (a *paddingOracleAttack) decrypt(cipher []byte, iv []byte) ([]byte, error) {
+	if len(iv) != a.blockSize || len(cipher)%a.blockSize != 0 {
+		return nil, ErrInvalidBlockLength
+	}
+
+	a.meter.setPhase("decrypt")
+
+	blocks := len(cipher) / a.blockSize
+	plaintext := make([]byte, len(cipher))
+
+	err := a.eachBlock(blocks, func(block int) error {
+		cipherBlock := cipher[block*a.blockSize : (block+1)*a.blockSize]
+
+		intermediate, err := a.intermediate(cipherBlock)
+		if err != nil {
+			return err
+		}
+
+		// The intermediate state XORed with the previous cipher block (or the IV
+		// for the first block) is the plaintext
+		previous := iv
+		if block > 0 {
+			previous = cipher[(block-1)*a.blockSize : block*a.blockSize]
+		}
+
+		copy(plaintext[block*a.blockSize:], calculateXor(intermediate, previous))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return plaintext, nil
+}
+
+// eachBlock calls fn for each block index, spread over the attack's concurrency.
+// The first error stops new blocks from being started and is returned
+func (a *paddingOracleAttack) eachBlock(blocks int, fn func(block int) error) error {
+	workers := a.concurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	work := make(chan int)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for block := range work {
+				if err := fn(block); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	var err error
+feed:
+	for block := 0; block < blocks; block++ {
+		select {
+		case work <- block:
+		case err = <-errs:
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if err == nil {
+		select {
+		case err = <-errs:
+		default:
+		}
+	}
+
+	return err
+}
+
+// query asks the oracle whether the cipher block is validly padded after
+// decrypting with the given previous block
+func (a *paddingOracleAttack) query(previous []byte, cipherBlock []byte) (bool, error) {
+	if err := a.meter.spend(len(previous) + len(cipherBlock)); err != nil {
+		return false, err
+	}
+	valid, err := a.oracle(previous, cipherBlock)
+	a.meter.received(1)
+
+	return valid, err
+}
+
+// intermediate recovers D(cipherBlock), the state before it's XORed with the
+// previous block.
+//
+// Each byte is found by forcing the bytes after it to the scheme's padding and
+// trying all 256 values for it. A value may also be accepted by accident when it
+// forms some other valid padding with the bytes before it, so every hit is
+// double checked with the previous byte changed. If more than one value still
+// passes then the oracle doesn't tell us anything about this byte.
+func (a *paddingOracleAttack) intermediate(cipherBlock []byte) ([]byte, error) {
+	intermediate := make([]byte, a.blockSize)
+
+	for element := a.blockSize - 1; element >= 0; element-- {
+		// Assume this element is the first element of padding, and get the
+		// bytes we want the block to end with
+		paddingBytes := a.padding.Example(a.blockSize - element)
+
+		// Set each element of the block that we've already calculated such that
+		// after decrypting they will equal the rest of the padding
+		cPrime := make([]byte, a.blockSize)
+		for j := a.blockSize - 1; j > element; j-- {
+			cPrime[j] = intermediate[j] ^ paddingBytes[j-element]
+		}
+
+		found := []byte{}
+		for cPrimeAttempt := 0; cPrimeAttempt < 256; cPrimeAttempt++ {
+			cPrime[element] = byte(cPrimeAttempt)
+
+			valid, err := a.query(cPrime, cipherBlock)
+			if err != nil {
+				return nil, err
+			}
+			if !valid {
+				continue
+			}
+
+			// Real padding doesn't care about the byte before it
+			if element > 0 {
+				cPrime[element-1] ^= 0x01
+				stillValid, err := a.query(cPrime, cipherBlock)
+				cPrime[element-1] ^= 0x01
+
+				if err != nil {
+					return nil, err
+				}
+				if !stillValid {
+					continue
+				}
+			}
+
+			found = append(found, byte(cPrimeAttempt))
+		}
+
+		if len(found) == 0 {
+			return nil, errors.New("No correct cPrime byte found")
+		} else if len(found) > 1 {
+			return nil, errPaddingOracleAmbiguous
+		}
+
+		intermediate[element] = found[0] ^ paddingBytes[0]
+	}
+
+	return intermediate, nil
+}
+
+// encrypt forges an IV and cipher which decrypt to the padded plaintext, also
+// known as CBC-R. Working backwards from a random final block, the intermediate
+// state of each block tells us what the block before it has to be for it to
+// decrypt to the plaintext we want. The blocks depend on each other so this
+// doesn't run concurrently
+func (a *paddingOracleAttack) encrypt(plaintext []byte) ([]byte, []byte, error) {
+	a.meter.setPhase("encrypt")
+
+	plaintext = a.padding.Pad(plaintext, a.blockSize)
+	blocks := len(plaintext) / a.blockSize
+
+	// Room for the IV in front of the cipher blocks
+	forged := make([]byte, len(plaintext)+a.blockSize)
+	copy(forged[blocks*a.blockSize:], randomBytes(a.blockSize))
+
+	for block := blocks - 1; block >= 0; block-- {
+		intermediate, err := a.intermediate(forged[(block+1)*a.blockSize : (block+2)*a.blockSize])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		plainBlock := plaintext[block*a.blockSize : (block+1)*a.blockSize]
+		copy(forged[block*a.blockSize:], calculateXor(intermediate, plainBlock))
+	}
+
+	return forged[:a.blockSize], forged[a.blockSize:], nil
+}
+
+// newPaddingOracleServer starts a loopback web service which decrypts requests
+// like /decrypt?iv=...&cipher=... (both hex) with the key and padding scheme. It
+// responds 200 for valid padding, 403 for bad padding and 400 for bad requests
+func newPaddingOracleServer(key []byte, padding Padding) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		iv, ivErr := hex.DecodeString(query.Get("iv"))
+		cipher, cipherErr := hex.DecodeString(query.Get("cipher"))
+		if ivErr != nil || cipherErr != nil {
+			http.Error(w, "Malformed request", http.StatusBadRequest)
+			return
+		}
+
+		_, err := decryptAESCBCWithPadding(cipher, iv, key, padding)
+		if errors.Is(err, ErrInvalidPadding) {
+			http.Error(w, "Invalid padding", http.StatusForbidden)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}))
+}
+
+// remotePaddingOracle returns a paddingOracle which asks a server such as
+// newPaddingOracleServer about each cipher
+func remotePaddingOracle(client *http.Client, baseURL string) paddingOracle {
+	return func(iv []byte, ciphertext []byte) (bool, error) {
+		query := url.Values{
+			"iv":     []string{hex.EncodeToString(iv)},
+			"cipher": []string{hex.EncodeToString(ciphertext)},
+		}
+
+		resp, err := client.Get(baseURL + "/decrypt?" + query.Encode())
+		if err != nil {
+			return false, err
+		}
+		resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return true, nil
+		case http.StatusForbidden:
+			return false, nil
+		}
+
+		return false, errors.New("Padding oracle responded " + resp.Status)
+	}
+}
@@ -2,6 +2,10 @@ package main
 
 import (
 	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -15,15 +19,15 @@ func TestChallenge1(t *testing.T) {
 }
 
 func TestChallenge2(t *testing.T) {
-	a := hexToBytes("1c0111001f010100061a024b53535009181c")
-	b := hexToBytes("686974207468652062756c6c277320657965")
-	c := hexToBytes("746865206b696420646f6e277420706c6179")
+	a := mustHexToBytes("1c0111001f010100061a024b53535009181c")
+	b := mustHexToBytes("686974207468652062756c6c277320657965")
+	c := mustHexToBytes("746865206b696420646f6e277420706c6179")
 
 	assert.Equal(t, c, calculateXor(a, b))
 }
 
 func TestChallenge3(t *testing.T) {
-	secret := hexToBytes("1b37373331363f78151b7f2b783431333d78397828372d363c78373e783a393b3736")
+	secret := mustHexToBytes("1b37373331363f78151b7f2b783431333d78397828372d363c78373e783a393b3736")
 
 	key, message := crackSingleByteXor(secret)
 
@@ -32,7 +36,7 @@ func TestChallenge3(t *testing.T) {
 }
 
 func TestChallenge4(t *testing.T) {
-	challenges := readHexSliceFile("data/4.txt")
+	challenges := mustReadHexSliceFile("data/4.txt")
 
 	// Crack each string in the file as a single byte xor cipher and find the most English-like
 	var winner []byte
@@ -58,7 +62,7 @@ func TestChallenge5(t *testing.T) {
 }
 
 func TestChallenge6(t *testing.T) {
-	secret := readBase64File("data/6.txt")
+	secret := mustReadBase64File("data/6.txt")
 
 	probableKeyLengths := findProbableKeyLengths(secret, 3)
 	key, message := crackRepeatingKeyXor(secret, probableKeyLengths)
@@ -69,15 +73,15 @@ func TestChallenge6(t *testing.T) {
 
 func TestChallenge7(t *testing.T) {
 	key := []byte("YELLOW SUBMARINE")
-	secret := readBase64File("data/7.txt")
+	secret := mustReadBase64File("data/7.txt")
 
-	message := decryptAESECB(secret, key)
+	message := mustDecryptAESECB(secret, key)
 
 	assert.Equal(t, []byte("I'm back and I'm"), message[0:16])
 }
 
 func TestChallenge8(t *testing.T) {
-	challenges := readHexSliceFile("data/8.txt")
+	challenges := mustReadHexSliceFile("data/8.txt")
 	blockSize := 16
 
 	var ecbLineNo int
@@ -90,3 +94,62 @@ func TestChallenge8(t *testing.T) {
 
 	assert.Equal(t, 132, ecbLineNo)
 }
+
+func TestDecodingErrors(t *testing.T) {
+	_, err := hexToBytes("not hex")
+	assert.True(t, errors.Is(err, ErrInvalidEncoding))
+
+	_, err = base64ToBytes("not base64!")
+	assert.True(t, errors.Is(err, ErrInvalidEncoding))
+
+	// Missing files are reported rather than read as empty
+	_, err = readBase64File("data/missing.txt")
+	assert.True(t, os.IsNotExist(err))
+	_, err = readBase64SliceFile("data/missing.txt")
+	assert.True(t, os.IsNotExist(err))
+	_, err = readHexSliceFile("data/missing.txt")
+	assert.True(t, os.IsNotExist(err))
+
+	// Badly encoded files
+	dir, err := ioutil.TempDir("", "cryptopals")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	badFile := filepath.Join(dir, "bad.txt")
+	assert.NoError(t, ioutil.WriteFile(badFile, []byte("aGVsbG8=\nnot base64 or hex!\n"), 0600))
+
+	_, err = readBase64File(badFile)
+	assert.True(t, errors.Is(err, ErrInvalidEncoding))
+	_, err = readBase64SliceFile(badFile)
+	assert.True(t, errors.Is(err, ErrInvalidEncoding))
+	assert.Contains(t, err.Error(), "bad.txt:2")
+	_, err = readHexSliceFile(badFile)
+	assert.True(t, errors.Is(err, ErrInvalidEncoding))
+
+	// The happy path still works
+	lines, err := readHexSliceFile("data/8.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, mustReadHexSliceFile("data/8.txt"), lines)
+}
+
+func TestAESECBErrors(t *testing.T) {
+	_, err := encryptAESECB(make([]byte, 16), []byte("short key"))
+	assert.True(t, errors.Is(err, ErrInvalidKeySize))
+
+	_, err = decryptAESECB(make([]byte, 16), []byte("short key"))
+	assert.True(t, errors.Is(err, ErrInvalidKeySize))
+
+	// Input has to be whole blocks
+	key := []byte("YELLOW SUBMARINE")
+	_, err = encryptAESECB([]byte("not padded"), key)
+	assert.True(t, errors.Is(err, ErrInvalidBlockLength))
+
+	_, err = decryptAESECB(make([]byte, 17), key)
+	assert.True(t, errors.Is(err, ErrInvalidBlockLength))
+
+	cipher, err := encryptAESECB(make([]byte, 32), key)
+	assert.NoError(t, err)
+	plaintext, err := decryptAESECB(cipher, key)
+	assert.NoError(t, err)
+	assert.Equal(t, make([]byte, 32), plaintext)
+}
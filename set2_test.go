@@ -1,6 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -10,8 +14,8 @@ func TestChallenge9(t *testing.T) {
 	a := []byte("YELLOW SUBMARINE")
 	b := pks7Pad(a, 25)
 
-	validatePks7Padded(b)
-	assert.True(t, isPks7Padded(b))
+	mustValidatePks7Padded(b, 25)
+	assert.True(t, isPks7Padded(b, 25))
 	assert.Equal(t, 0, len(b)%25)
 	assert.Equal(t, []byte{89, 69, 76, 76, 79, 87, 32, 83, 85, 66, 77, 65, 82, 73, 78, 69, 9, 9, 9, 9, 9, 9, 9, 9, 9}, b)
 }
@@ -22,17 +26,87 @@ func TestChallenge10(t *testing.T) {
 	blockSize := len(key)
 	iv := make([]byte, blockSize)
 
-	assert.Equal(t, message, pks7Unpad(decryptAESCBC(encryptAESCBC(message, iv, key), iv, key)))
+	plaintext, err := pks7Unpad(mustDecryptAESCBC(mustEncryptAESCBC(message, iv, key), iv, key), blockSize)
+	assert.NoError(t, err)
+	assert.Equal(t, message, plaintext)
 
-	message = readBase64File("data/10.txt")
+	// This is already a whole number of blocks so it doesn't get padded
+	message = mustReadBase64File("data/10.txt")
 	key = []byte("YELLOW SUBMARINE")
 	blockSize = len(key)
 	iv = make([]byte, blockSize)
 
-	assert.Equal(t, message, pks7Unpad(decryptAESCBC(encryptAESCBC(message, iv, key), iv, key)))
+	assert.Equal(t, message, mustDecryptAESCBC(mustEncryptAESCBC(message, iv, key), iv, key))
 
 }
 
+// largeCBCInput repeats the Challenge 10 data to get a sizeable input to benchmark with
+func largeCBCInput() []byte {
+	return pks7Pad(bytes.Repeat(mustReadBase64File("data/10.txt"), 64), 16)
+}
+
+func BenchmarkEncryptAESCBC(b *testing.B) {
+	message := largeCBCInput()
+	key := []byte("YELLOW SUBMARINE")
+	iv := make([]byte, 16)
+
+	b.SetBytes(int64(len(message)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mustEncryptAESCBC(message, iv, key)
+	}
+}
+
+func BenchmarkDecryptAESCBC(b *testing.B) {
+	key := []byte("YELLOW SUBMARINE")
+	iv := make([]byte, 16)
+	secret := mustEncryptAESCBC(largeCBCInput(), iv, key)
+
+	b.SetBytes(int64(len(secret)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mustDecryptAESCBC(secret, iv, key)
+	}
+}
+
+// BenchmarkStdlibEncryptAESCBC is a baseline to compare our CBC mode against
+func BenchmarkStdlibEncryptAESCBC(b *testing.B) {
+	message := largeCBCInput()
+	block, _ := aes.NewCipher([]byte("YELLOW SUBMARINE"))
+	iv := make([]byte, 16)
+	dst := make([]byte, len(message))
+
+	b.SetBytes(int64(len(message)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(dst, message)
+	}
+}
+
+func TestCBCBlockModeMatchesStdlib(t *testing.T) {
+	message := largeCBCInput()
+	key := []byte("YELLOW SUBMARINE")
+	iv := randomBytes(16)
+	block, _ := aes.NewCipher(key)
+
+	expected := make([]byte, len(message))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(expected, message)
+	assert.Equal(t, expected, mustEncryptAESCBC(message, iv, key))
+
+	// Streaming in uneven pieces should give the same result as one call
+	streamed := make([]byte, len(message))
+	mode := newCBCEncrypter(block, iv)
+	mode.CryptBlocks(streamed[:48], message[:48])
+	mode.CryptBlocks(streamed[48:], message[48:])
+	assert.Equal(t, expected, streamed)
+
+	// Decrypt in place, also in pieces
+	mode = newCBCDecrypter(block, iv)
+	mode.CryptBlocks(streamed[:16], streamed[:16])
+	mode.CryptBlocks(streamed[16:], streamed[16:])
+	assert.Equal(t, message, streamed)
+}
+
 func TestChallenge11(t *testing.T) {
 	message := []byte("YELLOW SUBMARINE")
 
@@ -51,16 +125,24 @@ func TestChallenge11(t *testing.T) {
 	assert.InEpsilon(t, 1, isECBCount[true]/isECBCount[false], 0.1)
 }
 
-// TODO: This takes way to long; speed it up
 func TestChallenge12(t *testing.T) {
 	// Verify it's ECB
 	ciphertext := ecbCipherOracle([]byte("YELLOW SUBMARINEYELLOW SUBMARINEYELLOW SUBMARINE"))
-	blockSize := detectECBBlockSize(ecbCipherOracle)
+	blockSize, err := detectECBBlockSize(newOracleMeter(0).wrap(ecbCipherOracle))
+	assert.NoError(t, err)
 	assert.True(t, isAESECB(ciphertext, blockSize))
 
 	// Crack it
-	message := crackECB(ecbCipherOracle)
+	meter := newOracleMeter(0)
+	message, err := crackECB(ecbCipherOracle, meter)
+	assert.NoError(t, err)
 	assert.Equal(t, []byte("Rollin' in my 5.0\nWith my rag-top down so my hair can blow\nThe girlies on standby waving just to say hi\nDid you stop? No, I just drove by\n"), message)
+
+	// One query per secret byte, plus a few to find the block size and secret length
+	queries := meter.stats("").queries
+	t.Logf("crackECB used %d oracle queries", queries)
+	assert.True(t, queries <= len(message)+2*blockSize+1)
+	assert.Equal(t, len(message), meter.stats("decrypt").queries)
 }
 
 func TestChallenge13(t *testing.T) {
@@ -74,14 +156,88 @@ func TestChallenge13(t *testing.T) {
 
 	// Stick the two together and decrypt for a poisoned profile
 	newCipher := append(attackerHalf, adminHalf...)
-	newProfile := decryptAESECB(newCipher, unknownOracleKey)
+	newProfile := mustDecryptAESECB(newCipher, unknownOracleKey)
 	assert.Equal(t, "email=attackerXXXXXXXX%40example.com&id=10&role=admin&id=10&role", string(newProfile))
 }
 
-// TODO: Doesn't really work yet, need to finish
+func TestParseQueryStringErrors(t *testing.T) {
+	_, err := parseQueryString("email=foo%zz")
+	assert.True(t, errors.Is(err, ErrInvalidEncoding))
+
+	values, err := parseQueryString("foo=bar&baz=qux&zap=zazzle")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"foo": "bar", "baz": "qux", "zap": "zazzle"}, values)
+}
+
 func TestChallenge14(t *testing.T) {
-	// oracle := ecbCipherWithPrependOrcale
-	// fmt.Println(string(crackECB(oracle)))
+	message, err := crackECB(ecbCipherWithPrependOrcale, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, unknownECBOracleSecret, message)
+}
+
+func TestAlignedECBOracleNeverAligned(t *testing.T) {
+	// A prefix which is never a whole number of blocks can't be worked around
+	key := randomBytes(16)
+	misaligned := func(message []byte) []byte {
+		message = append([]byte{0}, message...)
+		return mustEncryptAESECB(pks7Pad(message, 16), key)
+	}
+
+	_, err := alignedECBOracle(newOracleMeter(0).wrap(misaligned), 16)([]byte("hello"))
+	assert.True(t, errors.Is(err, errECBMarkerNotAligned))
+}
+
+func TestCrackECBDictionaryMiss(t *testing.T) {
+	// A secret which changes between queries never matches what's known so far
+	key := randomBytes(16)
+	changing := func(message []byte) []byte {
+		message = append(message, randomBytes(20)...)
+		return mustEncryptAESECB(pks7Pad(message, 16), key)
+	}
+
+	message, err := crackECB(changing, nil)
+	assert.Error(t, err)
+	assert.Nil(t, message)
+}
+
+func TestOracleMeterBudget(t *testing.T) {
+	// Not enough queries to get past the first few bytes
+	meter := newOracleMeter(40)
+	_, err := crackECB(ecbCipherOracle, meter)
+
+	assert.True(t, errors.Is(err, ErrOracleBudgetExceeded))
+	var budgetErr *oracleBudgetError
+	assert.True(t, errors.As(err, &budgetErr))
+	assert.Equal(t, "decrypt", budgetErr.phase)
+	assert.Equal(t, 40, meter.stats("").queries)
+
+	// Phase stats add up to the total
+	total := oracleStats{}
+	for _, phase := range []string{"block size", "secret length", "decrypt"} {
+		stats := meter.stats(phase)
+		total.add(stats.queries, stats.bytesIn, stats.bytesOut)
+	}
+	assert.Equal(t, meter.stats(""), total)
+	assert.True(t, total.bytesOut > 0)
+
+	// The padding oracle attack can be metered too
+	iv := make([]byte, 16)
+	cipher := cbcPaddingOracle(iv, PKCS7Padding)
+	meter = newOracleMeter(0)
+	plaintext, err := crackCBCWithPaddingOracle(localPaddingOracle(PKCS7Padding), cipher, iv, PKCS7Padding, meter)
+	assert.NoError(t, err)
+	assert.Equal(t, mustDecryptAESCBC(cipher, iv, unknownOracleKey), plaintext)
+	assert.True(t, meter.stats("decrypt").queries >= len(cipher))
+
+	_, err = crackCBCWithPaddingOracle(localPaddingOracle(PKCS7Padding), cipher, iv, PKCS7Padding, newOracleMeter(10))
+	assert.True(t, errors.Is(err, ErrOracleBudgetExceeded))
+
+	// An oracle which isn't ECB is an error rather than a panic
+	cbcOracle := func(message []byte) []byte {
+		return mustEncryptAESCBC(pks7Pad(message, 16), make([]byte, 16), unknownOracleKey)
+	}
+	_, err = crackECB(cbcOracle, nil)
+	assert.True(t, errors.Is(err, errECBNotDetected))
 }
 
 func TestChallenge15(t *testing.T) {
@@ -92,22 +248,182 @@ func TestChallenge15(t *testing.T) {
 	}
 
 	for str, shouldBeValid := range tests {
-		assert.Equal(t, shouldBeValid, isPks7Padded([]byte(str)))
+		assert.Equal(t, shouldBeValid, isPks7Padded([]byte(str), 16))
+	}
+}
+
+func TestStrictPks7Padding(t *testing.T) {
+	// Padding can't be longer than a block, even if the bytes are consistent
+	long := pks7Pad([]byte("YELLOW"), 32)
+	assert.True(t, isPks7Padded(long, 32))
+	assert.False(t, isPks7Padded(long, 16))
+
+	// Data has to be whole blocks
+	assert.False(t, isPks7Padded([]byte("ICE ICE BABY\x04\x04\x04\x04"), 5))
+
+	_, err := pks7Unpad([]byte("ICE ICE BABY\x05\x05\x05\x05"), 16)
+	assert.Equal(t, ErrInvalidPadding, err)
+
+	// Neither padding nor unpadding alias their input
+	data := make([]byte, 12, 32)
+	copy(data, "ICE ICE BABY")
+	padded := pks7Pad(data, 16)
+	padded[0] = 'X'
+	assert.Equal(t, "ICE ICE BABY", string(data))
+	assert.Equal(t, byte(0), data[:16][12])
+
+	unpadded, err := pks7Unpad(padded, 16)
+	assert.NoError(t, err)
+	unpadded[0] = 'N'
+	assert.Equal(t, byte('X'), padded[0])
+
+	// The constant time check agrees with the regular one for every last block
+	block := make([]byte, 16)
+	for last := 0; last < 256; last++ {
+		for fill := 0; fill < 18; fill++ {
+			for i := range block {
+				block[i] = byte(fill)
+			}
+			block[15] = byte(last)
+			assert.Equal(t, isPks7Padded(block, 16), isPks7PaddedConstantTime(block, 16))
+		}
+	}
+}
+
+func TestPaddingSchemes(t *testing.T) {
+	schemes := map[string]Padding{
+		"PKCS7":     PKCS7Padding,
+		"ANSIX923":  ANSIX923Padding,
+		"ISO7816":   ISO7816Padding,
+		"ISO10126":  ISO10126Padding,
+		"ZeroBytes": ZeroPadding,
+	}
+
+	// Every scheme round trips, pads to whole blocks, and doesn't touch its input
+	for name, padding := range schemes {
+		for length := 0; length <= 33; length++ {
+			data := make([]byte, length, 64)
+			for i := range data {
+				data[i] = 'A'
+			}
+
+			padded := padding.Pad(data, 16)
+			assert.Equal(t, 0, len(padded)%16, name)
+			assert.Equal(t, byte(0), data[:cap(data)][length], name)
+
+			unpadded, err := padding.Unpad(padded, 16)
+			assert.NoError(t, err, name)
+			assert.Equal(t, data, unpadded, name)
+		}
+	}
+
+	// What the padding looks like for each scheme
+	message := []byte("YELLOW SUBMARINE1234")
+	assert.Equal(t, []byte("\x0c\x0c\x0c\x0c\x0c\x0c\x0c\x0c\x0c\x0c\x0c\x0c"), PKCS7Padding.Pad(message, 16)[20:])
+	assert.Equal(t, []byte("\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x0c"), ANSIX923Padding.Pad(message, 16)[20:])
+	assert.Equal(t, []byte("\x80\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"), ISO7816Padding.Pad(message, 16)[20:])
+	assert.Equal(t, byte(12), ISO10126Padding.Pad(message, 16)[31])
+	assert.Equal(t, make([]byte, 12), ZeroPadding.Pad(message, 16)[20:])
+	assert.Equal(t, []byte("YELLOW SUBMARINE"), ZeroPadding.Pad([]byte("YELLOW SUBMARINE"), 16))
+
+	// Invalid padding for each scheme
+	invalid := map[string][]string{
+		"ANSIX923": {"ICE ICE BABY\x00\x01\x00\x04", "ICE ICE BABY\x00\x00\x00\x00", "ICE ICE BABY\x00\x00\x00\x11"},
+		"ISO7816":  {"ICE ICE BABY\x80\x00\x00\x01", "ICE ICE BABY\x00\x00\x00\x00", "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"},
+		"ISO10126": {"ICE ICE BABY\x00\x01\x00\x00", "ICE ICE BABY\x00\x01\x00\x11"},
+	}
+	for name, tests := range invalid {
+		for _, str := range tests {
+			_, err := schemes[name].Unpad([]byte(str), 16)
+			assert.Equal(t, ErrInvalidPadding, err, name+" "+str)
+		}
+	}
+
+	// Data has to be whole blocks for every scheme
+	for name, padding := range schemes {
+		_, err := padding.Unpad([]byte("ICE ICE BABY\x80\x00\x03"), 16)
+		assert.Equal(t, ErrInvalidPadding, err, name)
 	}
 }
 
+func TestAESWithPadding(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE")
+	iv := randomBytes(16)
+	message := []byte("YELLOW SUBMARINE")
+
+	cipher, err := encryptAESCBCWithPadding(message, iv, key, ANSIX923Padding)
+	assert.NoError(t, err)
+
+	// Always padded, even when the message is already a whole block
+	assert.Equal(t, 32, len(cipher))
+	plaintext, err := decryptAESCBCWithPadding(cipher, iv, key, ANSIX923Padding)
+	assert.NoError(t, err)
+	assert.Equal(t, message, plaintext)
+
+	// The wrong scheme is caught
+	_, err = decryptAESCBCWithPadding(cipher, iv, key, ISO7816Padding)
+	assert.Equal(t, ErrInvalidPadding, err)
+
+	cipher, err = encryptAESECBWithPadding(message, key, ISO7816Padding)
+	assert.NoError(t, err)
+	plaintext, err = decryptAESECBWithPadding(cipher, key, ISO7816Padding)
+	assert.NoError(t, err)
+	assert.Equal(t, message, plaintext)
+}
+
+func TestCBCNonLeakyReceiver(t *testing.T) {
+	iv := randomBytes(16)
+	cipher := cbcPaddingOracle(iv, PKCS7Padding)
+
+	plaintext, err := cbcNonLeakyReceiver(cipher, iv)
+	assert.NoError(t, err)
+	assert.Equal(t, byte('0'), plaintext[0])
+
+	// Flipping the last byte breaks the padding, and it's rejected like any failure
+	cipher[len(cipher)-17] ^= 0xff
+	assert.False(t, checkEncryptedCNCPadding(cipher, iv, PKCS7Padding))
+	_, err = cbcNonLeakyReceiver(cipher, iv)
+	assert.Equal(t, errCBCDecryptionFailed, err)
+
+	_, err = cbcNonLeakyReceiver(cipher[:20], iv)
+	assert.Equal(t, errCBCDecryptionFailed, err)
+}
+
+func TestPaddingErrors(t *testing.T) {
+	assert.True(t, errors.Is(validatePks7Padded([]byte("ICE ICE BABY\x01\x02\x03\x04"), 16), ErrInvalidPadding))
+	assert.True(t, errors.Is(validatePks7Padded([]byte{}, 16), ErrInvalidPadding))
+	assert.NoError(t, validatePks7Padded([]byte("ICE ICE BABY\x04\x04\x04\x04"), 16))
+}
+
+func TestAESCBCErrors(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE")
+	iv := make([]byte, 16)
+
+	_, err := encryptAESCBC([]byte("message"), iv, []byte("short key"))
+	assert.True(t, errors.Is(err, ErrInvalidKeySize))
+	_, err = decryptAESCBC(make([]byte, 16), iv, []byte("short key"))
+	assert.True(t, errors.Is(err, ErrInvalidKeySize))
+
+	_, err = encryptAESCBC([]byte("message"), iv[:8], key)
+	assert.True(t, errors.Is(err, ErrInvalidBlockLength))
+	_, err = decryptAESCBC(make([]byte, 16), iv[:8], key)
+	assert.True(t, errors.Is(err, ErrInvalidBlockLength))
+	_, err = decryptAESCBC(make([]byte, 20), iv, key)
+	assert.True(t, errors.Is(err, ErrInvalidBlockLength))
+}
+
 func TestChallenge16(t *testing.T) {
 	// Create a valid user profile and encrypt it
 	message := []byte(prepareUserData("1234567890123456-admin-true"))
 	iv := make([]byte, 16)
 	key := []byte("YELLOW SUBMARINE")
-	cipher := encryptAESCBC(message, iv, key)
+	cipher := mustEncryptAESCBC(message, iv, key)
 
 	// Change hyphens to characters that are sanitized out of the prepareUserData input
 	cipher[32] ^= '-' ^ ';'
 	cipher[38] ^= '-' ^ '='
 
 	// Decrypt it and we are now and admin
-	poisonedProfile := decryptAESCBC(cipher, iv, key)
+	poisonedProfile := mustDecryptAESCBC(cipher, iv, key)
 	assert.Contains(t, string(poisonedProfile), ";admin=true;")
 }
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
 	"math/rand"
+	"sort"
 	"testing"
 	"time"
 
@@ -13,26 +19,128 @@ func TestChallenge17(t *testing.T) {
 
 	plaintextsFingerprints := map[string]struct{}{}
 
-	// Oracle gives a random cipher so run a bunch of times so we hopefully get them all
-	for i := 0; i < 50; i++ {
-		cipher := cbcPaddingOracle(iv)
+	// Oracle gives a random cipher so keep going until we've seen them all
+	for i := 0; i < 1000 && len(plaintextsFingerprints) < 10; i++ {
+		cipher := cbcPaddingOracle(iv, PKCS7Padding)
 
-		for j := 0; j < 10; j++ {
-			plaintext, err := crackCBCWithPaddingOracle(cipher, iv)
-			if err == nil {
-				// Remember we've seen this plaintext
-				plaintextsFingerprints[string(plaintext[0:6])] = struct{}{}
-				break
-			}
+		plaintext, err := crackCBCWithPaddingOracle(localPaddingOracle(PKCS7Padding), cipher, iv, PKCS7Padding, nil)
+		if !assert.NoError(t, err) {
+			return
 		}
+
+		// Remember we've seen this plaintext
+		plaintextsFingerprints[string(plaintext[0:6])] = struct{}{}
 	}
 
 	// Ensure we've seen them all
 	assert.Equal(t, 10, len(plaintextsFingerprints))
 }
 
+func TestPaddingOracleSchemes(t *testing.T) {
+	iv := randomBytes(16)
+
+	// Any scheme which checks every padding byte leaks the whole plaintext
+	for _, padding := range []Padding{PKCS7Padding, ANSIX923Padding, ISO7816Padding} {
+		cipher := cbcPaddingOracle(iv, padding)
+		plaintext, err := crackCBCWithPaddingOracle(localPaddingOracle(padding), cipher, iv, padding, nil)
+		assert.NoError(t, err)
+
+		message, err := padding.Unpad(plaintext, 16)
+		assert.NoError(t, err)
+		assert.Equal(t, "0000", string(message[:4]))
+	}
+
+	// ISO 10126 only checks the last byte, which leaves the earlier bytes of each
+	// block out of reach, and zero padding checks nothing at all
+	for _, padding := range []Padding{ISO10126Padding, ZeroPadding} {
+		_, err := crackCBCWithPaddingOracle(localPaddingOracle(padding), cbcPaddingOracle(iv, padding), iv, padding, nil)
+		assert.True(t, errors.Is(err, errPaddingOracleAmbiguous))
+	}
+}
+
+func TestPaddingOracleAttack(t *testing.T) {
+	iv := randomBytes(16)
+	cipher := cbcPaddingOracle(iv, PKCS7Padding)
+
+	expected := mustDecryptAESCBC(cipher, iv, unknownOracleKey)
+
+	// Blocks can be attacked concurrently, every block including the first
+	meter := newOracleMeter(0)
+	attack := &paddingOracleAttack{oracle: localPaddingOracle(PKCS7Padding), padding: PKCS7Padding, blockSize: 16, concurrency: 4, meter: meter}
+	plaintext, err := attack.decrypt(cipher, iv)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, plaintext)
+	assert.True(t, meter.stats("decrypt").queries >= len(cipher))
+
+	// Running out of budget in a worker is still an error
+	attack.meter = newOracleMeter(100)
+	_, err = attack.decrypt(cipher, iv)
+	assert.True(t, errors.Is(err, ErrOracleBudgetExceeded))
+
+	// CBC-R encrypts whatever we like without knowing the key
+	attack.meter = nil
+	forgedIV, forged, err := attack.encrypt([]byte("comment1=cooking%20MCs;admin=true;comment2=%20like%20a%20pound%20of%20bacon"))
+	assert.NoError(t, err)
+
+	decrypted, err := decryptAESCBCWithPadding(forged, forgedIV, unknownOracleKey, PKCS7Padding)
+	assert.NoError(t, err)
+	assert.Equal(t, "comment1=cooking%20MCs;admin=true;comment2=%20like%20a%20pound%20of%20bacon", string(decrypted))
+
+	// The same attack works against an oracle on the other end of a connection
+	key := randomBytes(16)
+	server := newPaddingOracleServer(key, PKCS7Padding)
+	defer server.Close()
+
+	remoteCipher, err := encryptAESCBCWithPadding([]byte("Attack at dawn, bring snacks"), iv, key, PKCS7Padding)
+	assert.NoError(t, err)
+
+	remote := remotePaddingOracle(server.Client(), server.URL)
+	plaintext, err = crackCBCWithPaddingOracle(remote, remoteCipher, iv, PKCS7Padding, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, pks7Pad([]byte("Attack at dawn, bring snacks"), 16), plaintext)
+
+	// Malformed requests aren't mistaken for bad padding
+	_, err = remote(iv[:5], remoteCipher)
+	assert.Error(t, err)
+}
+
+func TestPaddingOracleForgery(t *testing.T) {
+	// Make sure the oracle's key exists before forging against it
+	cbcPaddingOracle(randomBytes(16), PKCS7Padding)
+
+	message := []byte("Nobody needs the key;admin=true;to write to this oracle")
+
+	meter := newOracleMeter(0)
+	iv, cipher, err := forgeCBCWithPaddingOracle(localPaddingOracle(PKCS7Padding), message, 16, PKCS7Padding, meter)
+	assert.NoError(t, err)
+	assert.Len(t, cipher, 64)
+	assert.True(t, meter.stats("encrypt").queries >= len(cipher))
+
+	plaintext := mustDecryptAESCBC(cipher, iv, unknownOracleKey)
+	plaintext, err = pks7Unpad(plaintext, 16)
+	assert.NoError(t, err)
+	assert.Equal(t, message, plaintext)
+
+	// The forged blocks end with a random block so forging again gives another cipher
+	_, again, err := forgeCBCWithPaddingOracle(localPaddingOracle(PKCS7Padding), message, 16, PKCS7Padding, nil)
+	assert.NoError(t, err)
+	assert.NotEqual(t, cipher, again)
+
+	// Other schemes forge too
+	iv, cipher, err = forgeCBCWithPaddingOracle(localPaddingOracle(ISO7816Padding), message, 16, ISO7816Padding, nil)
+	assert.NoError(t, err)
+
+	plaintext, err = decryptAESCBCWithPadding(cipher, iv, unknownOracleKey, ISO7816Padding)
+	assert.NoError(t, err)
+	assert.Equal(t, message, plaintext)
+
+	// Running out of budget is an error rather than a panic
+	_, _, err = forgeCBCWithPaddingOracle(localPaddingOracle(PKCS7Padding), message, 16, PKCS7Padding, newOracleMeter(50))
+	assert.True(t, errors.Is(err, ErrOracleBudgetExceeded))
+}
+
 func TestChallenge18(t *testing.T) {
-	cipher := base64ToBytes("L77na/nrFsKvynd6HzOoG7GHTLXsTVu9qvY/2syLXzhPweyyMTJULu/6/kXX0KSvoOLSFQ==")
+	cipher := mustBase64ToBytes("L77na/nrFsKvynd6HzOoG7GHTLXsTVu9qvY/2syLXzhPweyyMTJULu/6/kXX0KSvoOLSFQ==")
 	key := []byte("YELLOW SUBMARINE")
 	nonce := make([]byte, 8)
 
@@ -46,12 +154,90 @@ func TestChallenge18(t *testing.T) {
 	assert.Equal(t, plaintext, decryptAESCTR(cipher, key))
 }
 
+func TestAESCTRKeystream(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE")
+	nonce := randomBytes(8)
+	block, _ := aes.NewCipher(key)
+
+	// Encrypting zeros gives us the raw keystream; long enough to pass counter 255
+	keystream := calculateAESCTR(make([]byte, 16*300), key, nonce)
+
+	for _, counter := range []uint64{0, 1, 127, 128, 255, 256, 299} {
+		input := make([]byte, 16)
+		copy(input, nonce)
+		binary.LittleEndian.PutUint64(input[8:], counter)
+
+		expected := make([]byte, 16)
+		block.Encrypt(expected, input)
+		assert.Equal(t, expected, keystream[counter*16:(counter+1)*16])
+	}
+
+	// Seeking to any offset lines up with the keystream from the start
+	for _, offset := range []int{0, 5, 16, 2047, 2048, 4000} {
+		assert.Equal(t, keystream[offset:offset+37], mustCalculateAESCTRWithOffset(make([]byte, 37), key, nonce, offset))
+	}
+
+	// Streaming in pieces through the cipher.Stream interface matches one call
+	var stream cipher.Stream = newCTR(block, nonce)
+	streamed := make([]byte, len(keystream))
+	stream.XORKeyStream(streamed[:7], streamed[:7])
+	stream.XORKeyStream(streamed[7:], streamed[7:])
+	assert.Equal(t, keystream, streamed)
+}
+
 func TestChallenge19(t *testing.T) {
-	// TODO
+	messages := mustReadBase64SliceFile("data/19.txt")
+	key := randomBytes(16)
+	nonce := make([]byte, 8)
+
+	ciphers := make([][]byte, 0, len(messages))
+	for _, message := range messages {
+		ciphers = append(ciphers, calculateAESCTR(message, key, nonce))
+	}
+
+	// Frequency analysis alone gets the bulk of every line
+	keystream, confidence, err := crackFixedNonceCTR(ciphers, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "or polite meaningless words,", string(calculateXor(ciphers[5], keystream)))
+
+	// It can't tell the case of the first column, and the last few columns only
+	// have a line or two to go on, so the guesses there are weak
+	assert.True(t, confidence[0] < 0.2)
+	assert.True(t, confidence[len(confidence)-1] < 0.2)
+	assert.True(t, confidence[10] > 0.2)
+
+	// The longest line is recognisably Yeats so pin its ending, along with the
+	// capital letter the first line starts with
+	longest := 0
+	for i, cipher := range ciphers {
+		if len(cipher) > len(ciphers[longest]) {
+			longest = i
+		}
+	}
+
+	pins := []ctrPin{{cipher: 0, offset: 0, value: 'I'}}
+	ending := "is turn,"
+	for i := range ending {
+		offset := len(ciphers[longest]) - len(ending) + i
+		pins = append(pins, ctrPin{cipher: longest, offset: offset, value: ending[i]})
+	}
+
+	keystream, confidence, err = crackFixedNonceCTR(ciphers, pins)
+	assert.NoError(t, err)
+	for i, cipher := range ciphers {
+		assert.Equal(t, messages[i], calculateXor(cipher, keystream))
+	}
+	assert.Equal(t, float64(1), confidence[0])
+
+	// Pins have to land inside one of the ciphers
+	_, _, err = crackFixedNonceCTR(ciphers, []ctrPin{{cipher: len(ciphers), offset: 0}})
+	assert.Error(t, err)
+	_, _, err = crackFixedNonceCTR(ciphers, []ctrPin{{cipher: 0, offset: len(ciphers[0])}})
+	assert.Error(t, err)
 }
 
 func TestChallenge20(t *testing.T) {
-	messages := readBase64SliceFile("data/20.txt")
+	messages := mustReadBase64SliceFile("data/20.txt")
 	key := []byte("YELLOW SUBMARINE")
 	nonce := make([]byte, 8)
 
@@ -79,38 +265,278 @@ func TestChallenge20(t *testing.T) {
 }
 
 func TestChallenge21(t *testing.T) {
-	randomSeed := rand.Intn(99999)
-	mt1 := newMersenneTwister(randomSeed)
-	mt2 := newMersenneTwister(randomSeed)
+	randomSeed := uint32(rand.Intn(99999))
+	mt1 := NewMT19937(randomSeed)
+	mt2 := NewMT19937(randomSeed)
 
 	for i := 0; i < 100; i++ {
-		assert.Equal(t, mt1.next(), mt2.next())
+		assert.Equal(t, mt1.Uint32(), mt2.Uint32())
+	}
+}
+
+func TestMT19937ReferenceVectors(t *testing.T) {
+	// First outputs of mt19937ar.c's main(), seeded by init_by_array
+	mt := NewMT19937ByArray([]uint32{0x123, 0x234, 0x345, 0x456})
+	expected := []uint32{
+		1067595299, 955945823, 477289528, 4107218783, 4228976476,
+		3344332714, 3355579695, 227628506, 810200273, 2591290167,
+	}
+	for _, value := range expected {
+		assert.Equal(t, value, mt.Uint32())
+	}
+
+	// The default seed, as also used by C++'s std::mt19937
+	mt = NewMT19937(5489)
+	assert.Equal(t, uint32(3499211612), mt.Uint32())
+	for i := 1; i < 9999; i++ {
+		mt.Uint32()
+	}
+	assert.Equal(t, uint32(4123659995), mt.Uint32())
+}
+
+func TestMT19937Source(t *testing.T) {
+	var source rand.Source64 = NewMT19937(5489)
+	reference := NewMT19937(5489)
+
+	high, low := reference.Uint32(), reference.Uint32()
+	assert.Equal(t, uint64(high)<<32|uint64(low), source.Uint64())
+
+	high, low = reference.Uint32(), reference.Uint32()
+	assert.Equal(t, int64((uint64(high)<<32|uint64(low))>>1), source.Int63())
+
+	// Small seeds match the reference while large ones still use all their bits
+	source.Seed(5489)
+	assert.Equal(t, uint64(3499211612), source.Uint64()>>32)
+
+	source.Seed(1 << 40)
+	first := source.Uint64()
+	source.Seed(1<<40 + 1<<33)
+	assert.NotEqual(t, first, source.Uint64())
+
+	// It can back a *rand.Rand
+	r1 := rand.New(NewMT19937(42))
+	r2 := rand.New(NewMT19937(42))
+	assert.Equal(t, r1.Perm(20), r2.Perm(20))
+}
+
+func TestMT19937Serialization(t *testing.T) {
+	mt := NewMT19937ByArray([]uint32{1, 2, 3})
+	for i := 0; i < 1000; i++ {
+		mt.Uint32()
+	}
+
+	data, err := mt.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Len(t, data, 2500)
+
+	restored := &MT19937{}
+	assert.NoError(t, restored.UnmarshalBinary(data))
+	for i := 0; i < 1000; i++ {
+		assert.Equal(t, mt.Uint32(), restored.Uint32())
+	}
+
+	err = restored.UnmarshalBinary(data[:100])
+	assert.True(t, errors.Is(err, ErrInvalidEncoding))
+
+	binary.BigEndian.PutUint32(data[len(data)-4:], 625)
+	err = restored.UnmarshalBinary(data)
+	assert.True(t, errors.Is(err, ErrInvalidEncoding))
+}
+
+func TestMT64ReferenceVectors(t *testing.T) {
+	// First outputs of mt19937-64.c's main(), seeded by init_by_array64
+	mt, err := NewTwisterByArray(MT64Params, []uint64{0x12345, 0x23456, 0x34567, 0x45678})
+	assert.NoError(t, err)
+	expected := []uint64{
+		7266447313870364031, 4946485549665804864, 16945909448695747420,
+		16394063075524226720, 4873882236456199058,
+	}
+	for _, value := range expected {
+		assert.Equal(t, value, mt.Uint64())
+	}
+
+	// The default seed, as also used by C++'s std::mt19937_64
+	mt = NewTwister(MT64Params, 5489)
+	assert.Equal(t, uint64(14514284786278117030), mt.Uint64())
+	for i := 1; i < 9999; i++ {
+		mt.Uint64()
+	}
+	assert.Equal(t, uint64(9981545732273789042), mt.Uint64())
+
+	// The generic twister agrees with MT19937
+	generic := NewTwister(MT19937Params, 5489)
+	assert.Equal(t, NewMT19937(5489).Uint64(), generic.Uint64())
+
+	// Parameters without init_by_array multipliers can't seed from an array
+	params := MT19937Params
+	params.ArrayF1 = 0
+	_, err = NewTwisterByArray(params, []uint64{1})
+	assert.Error(t, err)
+}
+
+func TestTwisterCloning(t *testing.T) {
+	for name, params := range map[string]TwisterParams{"MT19937": MT19937Params, "MT19937-64": MT64Params} {
+		twister := NewTwister(params, rand.Uint64())
+
+		// Untempering undoes tempering for every word size
+		for i := 0; i < 1000; i++ {
+			word := params.mask(rand.Uint64())
+			assert.Equal(t, word, params.untemper(params.temper(word)), name)
+		}
+
+		// Outputs are all it takes to clone the twister
+		recoveredState := make([]uint64, params.N)
+		for i := range recoveredState {
+			recoveredState[i] = params.untemper(twister.next())
+		}
+
+		state, index := twister.State()
+		assert.Equal(t, state, recoveredState, name)
+
+		clone, err := NewTwisterFromState(params, recoveredState, index)
+		assert.NoError(t, err)
+		for i := 0; i < 1000; i++ {
+			assert.Equal(t, twister.next(), clone.next(), name)
+		}
+
+		// And so is its serialized state
+		data, err := twister.MarshalBinary()
+		assert.NoError(t, err)
+		assert.Len(t, data, int(params.N*params.W/8+4), name)
+
+		restored := NewTwister(params, 0)
+		assert.NoError(t, restored.UnmarshalBinary(data))
+		for i := 0; i < 1000; i++ {
+			assert.Equal(t, twister.next(), restored.next(), name)
+		}
+
+		_, err = NewTwisterFromState(params, recoveredState[1:], 0)
+		assert.Error(t, err)
 	}
 }
 
 func TestChallenge22(t *testing.T) {
-	seed := int(time.Now().Unix())
-	crackedSeed, err := crackMersenneTwisterSeed(newMersenneTwister(seed))
+	seed := uint32(time.Now().Unix())
+	crackedSeed, err := crackMersenneTwisterSeed(NewMT19937(seed))
 	assert.NoError(t, err)
 	assert.Equal(t, seed, crackedSeed)
 }
 
+func TestMT19937SeedSearch(t *testing.T) {
+	// Seeded an hour before a fake clock, with some outputs already used up
+	now := time.Date(2015, time.March, 14, 15, 9, 26, 0, time.UTC)
+	seed := uint32(now.Add(-time.Hour).Unix())
+	mt := NewMT19937(seed)
+
+	outputs := make([]uint32, 50)
+	for i := range outputs {
+		outputs[i] = mt.Uint32()
+	}
+	observations := []mt19937Output{{offset: 42, value: outputs[42]}, {offset: 7, value: outputs[7]}}
+
+	search := &mt19937SeedSearch{clock: func() time.Time { return now }, window: 2 * time.Hour, workers: 3}
+	candidates, err := search.crack(observations)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{seed}, candidates)
+
+	// The default window doesn't reach that far back
+	search.window = 0
+	_, err = search.crack(observations)
+	assert.Error(t, err)
+
+	// An explicit range ignores the clock
+	search = &mt19937SeedSearch{seeds: &seedRange{first: seed - 1000, last: seed + 1000}}
+	candidates, err = search.crack(observations)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{seed}, candidates)
+
+	// Even one which is just seed 0
+	zero := []mt19937Output{{offset: 0, value: NewMT19937(0).Uint32()}}
+	search = &mt19937SeedSearch{seeds: &seedRange{}}
+	candidates, err = search.crack(zero)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{0}, candidates)
+
+	// Every match is returned in order, not just the first. Only matching the low
+	// bits of one output leaves plenty of them
+	matches := searchAllSeeds(0, 1<<16, 0, func(candidate uint32) bool {
+		return NewMT19937(candidate).Uint32()&0xff == outputs[0]&0xff
+	})
+	assert.True(t, len(matches) > 100)
+	assert.True(t, sort.SliceIsSorted(matches, func(a, b int) bool { return matches[a] < matches[b] }))
+
+	_, err = search.crack(nil)
+	assert.Error(t, err)
+}
+
 func TestChallenge23(t *testing.T) {
-	stateLength := 624
-	recoveredState := make([]int, stateLength)
-	twister := newMersenneTwister(rand.Intn(99999))
+	var recoveredState [mersenneTwisterStateLength]uint32
+	twister := NewMT19937(uint32(rand.Intn(99999)))
 
-	for i := 0; i < stateLength; i++ {
-		recoveredState[i] = untemperMersenneTwisterNumber(twister.next())
+	for i := range recoveredState {
+		recoveredState[i] = untemperMersenneTwisterNumber(twister.Uint32())
 	}
 
-	assert.Equal(t, twister.state, recoveredState)
+	state, index := twister.State()
+	assert.Equal(t, state, recoveredState)
 
-	clone := newMersenneTwister(0)
-	clone.state = recoveredState
+	clone, err := NewMT19937FromState(recoveredState, index)
+	assert.NoError(t, err)
 	for i := 0; i < 100; i++ {
-		assert.Equal(t, twister.next(), clone.next())
+		assert.Equal(t, twister.Uint32(), clone.Uint32())
 	}
+
+	_, err = NewMT19937FromState(recoveredState, 625)
+	assert.Error(t, err)
+}
+
+func TestRecoverTwister(t *testing.T) {
+	// Known plaintext gives us the low byte of each output of the stream cipher,
+	// which is enough to decrypt whatever comes next
+	key := randomBytes(16)
+	known := bytes.Repeat([]byte{'A'}, 5000)
+	secret := []byte("The rest of the message is no secret either")
+	cipher := mustCalculateMT19937(append(known, secret...), key)
+
+	keystream := calculateXor(cipher[:len(known)], known)
+	clone, err := recoverMT19937FromKeystream(keystream)
+	assert.NoError(t, err)
+
+	plaintext := make([]byte, len(secret))
+	for i := range plaintext {
+		plaintext[i] = cipher[len(known)+i] ^ byte(clone.Uint32())
+	}
+	assert.Equal(t, secret, plaintext)
+
+	// A mix of full, truncated and missing outputs works too
+	for name, params := range map[string]TwisterParams{"MT19937": MT19937Params, "MT19937-64": MT64Params} {
+		twister := NewTwister(params, rand.Uint64())
+		observations := make([]twisterObservation, 5*params.N)
+		for i := range observations {
+			output := twister.next()
+			switch i % 5 {
+			case 0:
+				observations[i] = twisterObservation{value: output, mask: params.mask(^uint64(0))}
+			case 1, 2:
+				mask := params.mask(^uint64(0)) >> (params.W / 2)
+				observations[i] = twisterObservation{value: output & mask, mask: mask}
+			case 3:
+				observations[i] = twisterObservation{value: output & 0xff, mask: 0xff}
+			}
+		}
+
+		clone, err := recoverTwister(params, observations)
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+		for i := 0; i < 1000; i++ {
+			assert.Equal(t, twister.next(), clone.next(), name)
+		}
+	}
+
+	// Too little data is reported rather than guessed at
+	_, err = recoverMT19937FromKeystream(keystream[:1000])
+	assert.True(t, errors.Is(err, errTwisterUnderdetermined))
 }
 
 func TestChallenge24(t *testing.T) {
@@ -118,6 +544,41 @@ func TestChallenge24(t *testing.T) {
 	message := []byte("HELLO, WORLD!")
 
 	// Test MT19937 stream cipher
-	assert.Equal(t, message, calculateMT19937(calculateMT19937(message, key), key))
+	assert.Equal(t, message, mustCalculateMT19937(mustCalculateMT19937(message, key), key))
+
+	// Recover the 16-bit seed from a known plaintext behind a random prefix
+	known := []byte("AAAAAAAAAAAAAA")
+	seed, err := crackMT19937StreamSeed(mt19937PrefixOracle(known), known, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, unknownMT19937Seed, seed)
+
+	_, err = crackMT19937StreamSeed(randomBytes(30), known, 4)
+	assert.Error(t, err)
+
+	// Spot a password reset token made from the current time
+	now := time.Now()
+	token := mt19937ResetToken(now.Add(-90 * time.Second))
+	tokenSeed, ok := isMT19937ResetToken(token, now, 10*time.Minute, 0)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(now.Unix()-90), tokenSeed)
+
+	_, ok = isMT19937ResetToken(randomBytes(16), now, 10*time.Minute, 0)
+	assert.False(t, ok)
+
+	// A window reaching back past the epoch starts at seed 0 instead of wrapping
+	early := time.Unix(30, 0)
+	tokenSeed, ok = isMT19937ResetToken(mt19937ResetToken(time.Unix(10, 0)), early, 10*time.Minute, 0)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(10), tokenSeed)
+}
+
+func TestStreamCipherErrors(t *testing.T) {
+	_, err := calculateMT19937([]byte("HELLO, WORLD!"), []byte("short key"))
+	assert.True(t, errors.Is(err, ErrInvalidKeySize))
+
+	_, err = calculateAESCTRWithOffset([]byte("HELLO, WORLD!"), []byte("short key"), make([]byte, 8), 0)
+	assert.True(t, errors.Is(err, ErrInvalidKeySize))
 
+	_, err = calculateAESCTRWithOffset([]byte("HELLO, WORLD!"), []byte("YELLOW SUBMARINE"), make([]byte, 16), 0)
+	assert.True(t, errors.Is(err, ErrInvalidBlockLength))
 }
@@ -1,19 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
 	"encoding/hex"
+	"flag"
+	"math/rand"
+	"net/http"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
-	"github.com/tyler-smith/matasano-cryptopals/sha1"
+	"github.com/tyler-smith/matasano-cryptopals/md4"
 )
 
 func TestChallenge25(t *testing.T) {
 	key := []byte("YELLOW SUBMARINE")
 
 	nonce := make([]byte, 16)
-	cipher := append(nonce, readBase64File("data/25.txt")...)
-	message := decryptAESECB(cipher, key)
+	cipher := append(nonce, mustReadBase64File("data/25.txt")...)
+	message := mustDecryptAESECB(cipher, key)
 
 	cipher = ctrEditOracleEncrypter(message)
 
@@ -42,6 +49,13 @@ func TestChallenge26(t *testing.T) {
 }
 
 func TestChallenge27(t *testing.T) {
+	// Normal traffic goes through fine
+	message := []byte(prepareUserData("hello"))
+	assert.NoError(t, cbcKeyAsIVReceiver(cbcKeyAsIVEncrypter(message)))
+
+	key, err := crackCBCKeyAsIV(cbcKeyAsIVEncrypter, cbcKeyAsIVReceiver)
+	assert.NoError(t, err)
+	assert.Equal(t, unknownOracleKey, key)
 }
 
 func TestChallenge28(t *testing.T) {
@@ -56,8 +70,7 @@ func TestChallenge28(t *testing.T) {
 }
 
 func TestChallenge29(t *testing.T) {
-	keyLength := 8
-	randomKey := randomBytes(keyLength)
+	randomKey := randomBytes(8 + rand.Intn(24))
 
 	createMAC := func(message []byte) []byte {
 		return Sha1KeyedMAC(randomKey, message)
@@ -75,22 +88,164 @@ func TestChallenge29(t *testing.T) {
 	chosenPlaintextMAC := createMAC(chosenPlaintext)
 	assert.True(t, verifyMAC(chosenPlaintext, chosenPlaintextMAC))
 
-	// Create poison message which sets admin=true
-	// We create a message padded for message+keyLength bytes, but remove the first
-	// keyLength bytes since they're junk. The victim will prepend their key and
-	// then it will all line up
+	// Forge a message which sets admin=true without knowing the key or its length
+	payload := []byte(";admin=true")
+	forgedMessage, forgedMAC, err := forgeLengthExtension(sha1LengthExtension, verifyMAC, chosenPlaintext, chosenPlaintextMAC, payload, 0, 64)
+	assert.NoError(t, err)
+	assert.True(t, verifyMAC(forgedMessage, forgedMAC))
+	assert.True(t, bytes.HasSuffix(forgedMessage, payload))
+
+	// The forgery starts with the original message
+	assert.Equal(t, chosenPlaintext, forgedMessage[:len(chosenPlaintext)])
+}
+
+func TestChallenge30(t *testing.T) {
+	// Sanity check our MD4 against the RFC 1320 test suite
+	assert.Equal(t, "a448017aaf21d8525fc10ae87aa6729d", hex.EncodeToString(Md4KeyedMAC(nil, []byte("abc"))))
+
+	keyLength := 8
+	randomKey := randomBytes(keyLength)
+
+	createMAC := func(message []byte) []byte {
+		return Md4KeyedMAC(randomKey, message)
+	}
+
+	verifyMAC := func(message []byte, mac []byte) bool {
+		if string(Md4KeyedMAC(randomKey, message)) == string(mac) {
+			return true
+		}
+		return false
+	}
+
+	// Create a hash for a chosen plaintext
+	chosenPlaintext := []byte("comment1=cooking%20MCs;userdata=foo;comment2=%20like%20a%20pound%20of%20bacon")
+	chosenPlaintextMAC := createMAC(chosenPlaintext)
+	assert.True(t, verifyMAC(chosenPlaintext, chosenPlaintextMAC))
+
+	// Create poison message which sets admin=true, the same way as for SHA1
 	poisonText := make([]byte, keyLength)
-	poisonText = sha1Pad(append(poisonText, chosenPlaintext...))
+	poisonText = md4Pad(append(poisonText, chosenPlaintext...))
 	poisonText = poisonText[keyLength:]
 
 	// Add the admin=true bit
 	payload := []byte(";admin=true")
 	poisonText = append(poisonText, payload...)
 
-	// Create a Sha1 calculate pre-set to use regsiters and desired length
-	sha1Forger := sha1.NewWithGivenRegisters(sha1HashToRegisters(chosenPlaintextMAC), uint64(len(poisonText)+keyLength))
-	sha1Forger.Write(payload)
-	forgedMAC := sha1Forger.Sum(nil)
+	// Create an MD4 calculator pre-set to use registers and desired length
+	md4Forger := md4.NewWithGivenRegisters(md4HashToRegisters(chosenPlaintextMAC), uint64(len(poisonText)+keyLength))
+	md4Forger.Write(payload)
+	forgedMAC := md4Forger.Sum(nil)
 
 	assert.True(t, verifyMAC(poisonText, forgedMAC))
 }
+
+func TestForgeLengthExtensionMD4(t *testing.T) {
+	randomKey := randomBytes(8 + rand.Intn(24))
+	verifyMAC := func(message []byte, mac []byte) bool {
+		return string(Md4KeyedMAC(randomKey, message)) == string(mac)
+	}
+
+	message := []byte("comment1=cooking%20MCs;userdata=foo;comment2=%20like%20a%20pound%20of%20bacon")
+	payload := []byte(";admin=true")
+	forgedMessage, forgedMAC, err := forgeLengthExtension(md4LengthExtension, verifyMAC, message, Md4KeyedMAC(randomKey, message), payload, 0, 64)
+	assert.NoError(t, err)
+	assert.True(t, verifyMAC(forgedMessage, forgedMAC))
+
+	// Giving up when the key length is outside the range
+	_, _, err = forgeLengthExtension(md4LengthExtension, verifyMAC, message, Md4KeyedMAC(randomKey, message), payload, 0, 4)
+	assert.Error(t, err)
+}
+
+// timingFull runs the timing attacks against every byte of the HMAC. Each byte
+// costs hundreds of requests that take longer the further along it is, so it's
+// off by default and the tests crack an HMAC truncated to a few bytes instead
+var timingFull = flag.Bool("timing.full", false, "crack the full HMAC in the timing attack tests")
+
+// checkHMACTimingSignature asserts the signature is accepted by the server
+func checkHMACTimingSignature(t *testing.T, baseURL string, file string, signature []byte) {
+	resp, err := http.Get(baseURL + "/test?file=" + file + "&signature=" + hex.EncodeToString(signature))
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestChallenge31(t *testing.T) {
+	key := randomBytes(16)
+	file := "foo"
+
+	// Our HMAC should match the standard library's
+	mac := hmac.New(sha1.New, key)
+	mac.Write([]byte(file))
+	assert.Equal(t, mac.Sum(nil), HmacSha1(key, []byte(file)))
+
+	_, err := newHMACTimingServer(key, sha1.Size+1, 0)
+	assert.Error(t, err)
+
+	// A truncated HMAC is recovered the same way as a full one, only sooner
+	server, err := newHMACTimingServer(key, 3, 20*time.Millisecond)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.Close()
+
+	signature, err := crackHMACTiming(server.URL, file, 3, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, HmacSha1(key, []byte(file))[:3], signature)
+	checkHMACTimingSignature(t, server.URL, file, signature)
+
+	_, err = crackHMACTiming(server.URL, file, 0, 1)
+	assert.Error(t, err)
+
+	t.Run("full", func(t *testing.T) {
+		if !*timingFull {
+			t.Skip("skipping the full HMAC; run with -timing.full")
+		}
+
+		full, err := newHMACTimingServer(key, sha1.Size, 20*time.Millisecond)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer full.Close()
+
+		signature, err := crackHMACTiming(full.URL, file, sha1.Size, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, HmacSha1(key, []byte(file)), signature)
+		checkHMACTimingSignature(t, full.URL, file, signature)
+	})
+}
+
+func TestChallenge32(t *testing.T) {
+	key := randomBytes(16)
+	file := "foo"
+
+	// With only a couple of milliseconds to go on, repeat each measurement
+	server, err := newHMACTimingServer(key, 4, 2*time.Millisecond)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.Close()
+
+	signature, err := crackHMACTiming(server.URL, file, 4, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, HmacSha1(key, []byte(file))[:4], signature)
+	checkHMACTimingSignature(t, server.URL, file, signature)
+
+	t.Run("full", func(t *testing.T) {
+		if !*timingFull {
+			t.Skip("skipping the full HMAC; run with -timing.full")
+		}
+
+		full, err := newHMACTimingServer(key, sha1.Size, 2*time.Millisecond)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer full.Close()
+
+		signature, err := crackHMACTiming(full.URL, file, sha1.Size, 5)
+		assert.NoError(t, err)
+		assert.Equal(t, HmacSha1(key, []byte(file)), signature)
+		checkHMACTimingSignature(t, full.URL, file, signature)
+	})
+}
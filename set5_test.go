@@ -0,0 +1,393 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tyler-smith/matasano-cryptopals/dh"
+)
+
+func TestChallenge33(t *testing.T) {
+	// Toy numbers first
+	toy := &dh.Group{P: big.NewInt(37), G: big.NewInt(5)}
+	a, b := toy.KeyPair(big.NewInt(7)), toy.KeyPair(big.NewInt(11))
+	assert.Equal(t, int64(18), a.Public.Int64())
+	assert.Equal(t, int64(2), b.Public.Int64())
+
+	s1, err := a.SharedSecret(b.Public)
+	assert.NoError(t, err)
+	s2, err := b.SharedSecret(a.Public)
+	assert.NoError(t, err)
+	assert.Equal(t, s1, s2)
+
+	// Groups built by hand are checked before picking a private exponent
+	for _, bad := range []*dh.Group{{P: big.NewInt(3), G: big.NewInt(2)}, {G: big.NewInt(2)}, {P: big.NewInt(37)}} {
+		_, err := bad.GenerateKey()
+		assert.True(t, errors.Is(err, dh.ErrInvalidGroup))
+	}
+	_, err = toy.GenerateKey()
+	assert.NoError(t, err)
+
+	// Then the real group
+	group := dh.RFC3526Group1536
+	assert.True(t, group.P.ProbablyPrime(20))
+	assert.True(t, group.Q.ProbablyPrime(20))
+
+	alice, err := group.GenerateKey()
+	assert.NoError(t, err)
+	bob, err := group.GenerateKey()
+	assert.NoError(t, err)
+	assert.NotEqual(t, alice.Private, bob.Private)
+
+	s1, err = alice.SharedSecret(bob.Public)
+	assert.NoError(t, err)
+	s2, err = bob.SharedSecret(alice.Public)
+	assert.NoError(t, err)
+	assert.Equal(t, s1, s2)
+
+	key := dh.AESKey(s1)
+	assert.Len(t, key, 16)
+	assert.Equal(t, key, dh.AESKey(s2))
+
+	// Both parties can now talk
+	iv := randomBytes(16)
+	cipher := mustEncryptAESCBC(pks7Pad([]byte("Hi Bob"), 16), iv, key)
+	plaintext, err := pks7Unpad(mustDecryptAESCBC(cipher, iv, dh.AESKey(s2)), 16)
+	assert.NoError(t, err)
+	assert.Equal(t, "Hi Bob", string(plaintext))
+}
+
+func TestDHPublicKeyValidation(t *testing.T) {
+	group := dh.RFC3526Group1536
+	key, err := group.GenerateKey()
+	assert.NoError(t, err)
+
+	// p-g is in range but outside the subgroup of order q
+	pMinusOne := new(big.Int).Sub(group.P, big.NewInt(1))
+	pMinusG := new(big.Int).Sub(group.P, group.G)
+	for _, public := range []*big.Int{big.NewInt(-2), big.NewInt(0), big.NewInt(1), pMinusOne, group.P, pMinusG} {
+		_, err := key.SharedSecret(public)
+		assert.True(t, errors.Is(err, dh.ErrInvalidPublicKey), public.String())
+	}
+
+	// Real public values are fine
+	_, err = key.SharedSecret(group.G)
+	assert.NoError(t, err)
+}
+
+// dhEavesdropper records every message without changing anything
+type dhEavesdropper struct {
+	mu       sync.Mutex
+	messages []dhMessage
+}
+
+func (e *dhEavesdropper) intercept(fromA bool, message dhMessage) dhMessage {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.messages = append(e.messages, message)
+	return message
+}
+
+// dhTamperer rewrites messages with tamper, which may break them
+type dhTamperer struct {
+	tamper func(fromA bool, message dhMessage) dhMessage
+}
+
+func (d *dhTamperer) intercept(fromA bool, message dhMessage) dhMessage {
+	return d.tamper(fromA, message)
+}
+
+func TestDHEchoMalformedMessages(t *testing.T) {
+	messages := [][]byte{[]byte("Hello Bob")}
+
+	// Whatever an interceptor sends is an error rather than a panic
+	tests := map[string]struct {
+		tamper    func(fromA bool, message dhMessage) dhMessage
+		negotiate bool
+		aErr      error
+		bErr      error
+	}{
+		"no p in the hello": {
+			tamper: func(fromA bool, message dhMessage) dhMessage {
+				message.p = nil
+				return message
+			},
+			aErr: errDHConnectionClosed,
+			bErr: dh.ErrInvalidGroup,
+		},
+		"tiny p in the hello": {
+			tamper: func(fromA bool, message dhMessage) dhMessage {
+				if message.p != nil {
+					message.p = big.NewInt(3)
+				}
+				return message
+			},
+			aErr: errDHConnectionClosed,
+			bErr: dh.ErrInvalidGroup,
+		},
+		"no g in the ack": {
+			tamper: func(fromA bool, message dhMessage) dhMessage {
+				if !fromA {
+					message.g = nil
+				}
+				return message
+			},
+			negotiate: true,
+			aErr:      dh.ErrInvalidGroup,
+			bErr:      errDHConnectionClosed,
+		},
+		"no public value in the reply": {
+			tamper: func(fromA bool, message dhMessage) dhMessage {
+				if !fromA {
+					message.public = nil
+				}
+				return message
+			},
+			aErr: errDHMissingPublic,
+		},
+		"no public value in the negotiated hello": {
+			tamper: func(fromA bool, message dhMessage) dhMessage {
+				if fromA && message.p == nil {
+					message.public = nil
+				}
+				return message
+			},
+			negotiate: true,
+			aErr:      errDHConnectionClosed,
+			bErr:      errDHMissingPublic,
+		},
+	}
+
+	for name, test := range tests {
+		aErr, bErr := runDHEcho(dh.RFC3526Group1536, messages, &dhTamperer{tamper: test.tamper}, dhEchoOptions{negotiate: test.negotiate})
+		assert.True(t, errors.Is(aErr, test.aErr), name)
+		assert.True(t, errors.Is(bErr, test.bErr), name)
+	}
+}
+
+func TestChallenge34(t *testing.T) {
+	messages := [][]byte{[]byte("Hello Bob"), []byte("Nice weather today"), []byte("Bye now")}
+
+	// Without anyone in between
+	aErr, bErr := runDHEcho(dh.RFC3526Group1536, messages, nil, dhEchoOptions{})
+	assert.NoError(t, aErr)
+	assert.NoError(t, bErr)
+
+	// Passive interceptors see ciphers but can't read them
+	eavesdropper := &dhEavesdropper{}
+	aErr, bErr = runDHEcho(dh.RFC3526Group1536, messages, eavesdropper, dhEchoOptions{validate: true})
+	assert.NoError(t, aErr)
+	assert.NoError(t, bErr)
+	assert.Len(t, eavesdropper.messages, 2+2*len(messages))
+
+	// Fixing the key lets the MITM read everything without A or B noticing
+	mitm := &dhKeyFixingMITM{}
+	aErr, bErr = runDHEcho(dh.RFC3526Group1536, messages, mitm, dhEchoOptions{})
+	assert.NoError(t, aErr)
+	assert.NoError(t, bErr)
+	assert.Empty(t, mitm.errs)
+	assert.Equal(t, messages, mitm.plaintexts)
+
+	// Validating public values stops it
+	mitm = &dhKeyFixingMITM{}
+	aErr, bErr = runDHEcho(dh.RFC3526Group1536, messages, mitm, dhEchoOptions{validate: true})
+	assert.True(t, errors.Is(bErr, dh.ErrInvalidPublicKey))
+	assert.Equal(t, errDHConnectionClosed, aErr)
+	assert.Empty(t, mitm.plaintexts)
+}
+
+func TestChallenge35(t *testing.T) {
+	messages := [][]byte{[]byte("Hello Bob"), []byte("Nice weather today"), []byte("Bye now")}
+	p := dh.RFC3526Group1536.P
+
+	// The negotiated protocol works on its own, and key fixing still works on it
+	aErr, bErr := runDHEcho(dh.RFC3526Group1536, messages, nil, dhEchoOptions{negotiate: true, validate: true})
+	assert.NoError(t, aErr)
+	assert.NoError(t, bErr)
+
+	fixer := &dhKeyFixingMITM{}
+	aErr, bErr = runDHEcho(dh.RFC3526Group1536, messages, fixer, dhEchoOptions{negotiate: true})
+	assert.NoError(t, aErr)
+	assert.NoError(t, bErr)
+	assert.Equal(t, messages, fixer.plaintexts)
+
+	fakeGs := map[string]func(p *big.Int) *big.Int{
+		"g = 1":   func(p *big.Int) *big.Int { return big.NewInt(1) },
+		"g = p":   func(p *big.Int) *big.Int { return new(big.Int).Set(p) },
+		"g = p-1": func(p *big.Int) *big.Int { return new(big.Int).Sub(p, big.NewInt(1)) },
+	}
+
+	for name, fakeG := range fakeGs {
+		// Run a few times so g = p-1 likely sees both of its secrets
+		for i := 0; i < 4; i++ {
+			mitm := &dhMaliciousGMITM{fakeG: fakeG}
+			aErr, bErr := runDHEcho(dh.RFC3526Group1536, messages, mitm, dhEchoOptions{negotiate: true})
+			assert.NoError(t, aErr, name)
+			assert.NoError(t, bErr, name)
+			assert.Empty(t, mitm.errs, name)
+			assert.Equal(t, messages, mitm.plaintexts, name)
+		}
+
+		// Every one of them gives public values that validation rejects
+		mitm := &dhMaliciousGMITM{fakeG: fakeG}
+		aErr, bErr := runDHEcho(dh.RFC3526Group1536, messages, mitm, dhEchoOptions{negotiate: true, validate: true})
+		assert.True(t, errors.Is(aErr, dh.ErrInvalidPublicKey) || errors.Is(bErr, dh.ErrInvalidPublicKey), name)
+		assert.Empty(t, mitm.plaintexts, name)
+	}
+
+	// Both outcomes for g = p-1 are predicted
+	pMinusOne := new(big.Int).Sub(p, big.NewInt(1))
+	group := &dh.Group{P: p, G: pMinusOne}
+	for _, exponents := range [][2]int64{{2, 4}, {2, 3}, {3, 2}, {3, 5}} {
+		a, b := group.KeyPair(big.NewInt(exponents[0])), group.KeyPair(big.NewInt(exponents[1]))
+
+		secret, err := maliciousGSecret(p, pMinusOne, []*big.Int{a.Public, b.Public})
+		assert.NoError(t, err)
+		assert.Equal(t, a.UncheckedSharedSecret(b.Public), secret)
+	}
+
+	_, err := maliciousGSecret(p, pMinusOne, nil)
+	assert.Error(t, err)
+
+	_, err = maliciousGSecret(p, big.NewInt(2), nil)
+	assert.Error(t, err)
+}
+
+// startSRPServer runs the server on a loopback listener until the test ends
+func startSRPServer(t *testing.T, server *srpServer) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go server.serve(listener)
+	return listener
+}
+
+func srpLoginOver(t *testing.T, listener net.Listener, client *srpClient) error {
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	return client.login(conn)
+}
+
+func TestChallenge36(t *testing.T) {
+	params := newSRPParams(dh.RFC3526Group1536)
+	server := newSRPServer(params)
+	server.register("alice@example.com", "correct horse battery staple")
+
+	// Both sides end up with the same key without the password being sent
+	client := newSRPClient(params, "alice@example.com", "correct horse battery staple")
+	hello, err := client.hello()
+	assert.NoError(t, err)
+	session, challenge, err := server.hello(hello)
+	assert.NoError(t, err)
+	proof, err := client.respond(challenge)
+	assert.NoError(t, err)
+	assert.NoError(t, session.verify(proof))
+	assert.Equal(t, session.key, client.key)
+
+	// And over the network
+	listener := startSRPServer(t, server)
+	assert.NoError(t, srpLoginOver(t, listener, client))
+
+	wrong := newSRPClient(params, "alice@example.com", "Tr0ub4dor&3")
+	assert.Equal(t, errSRPAuthenticationFailed, srpLoginOver(t, listener, wrong))
+
+	unknown := newSRPClient(params, "mallory@example.com", "correct horse battery staple")
+	assert.Equal(t, errSRPAuthenticationFailed, srpLoginOver(t, listener, unknown))
+
+	// The client won't go along with a server value which fixes the key
+	_, err = client.respond(srpChallenge{Salt: challenge.Salt, B: params.n})
+	assert.Error(t, err)
+}
+
+func TestChallenge37(t *testing.T) {
+	params := newSRPParams(dh.RFC3526Group1536)
+	password := "correct horse battery staple"
+
+	server := newSRPServer(params)
+	server.register("alice@example.com", password)
+	listener := startSRPServer(t, server)
+
+	hardened := newSRPServer(params)
+	hardened.register("alice@example.com", password)
+	hardened.hardened = true
+	hardenedListener := startSRPServer(t, hardened)
+
+	dial := func(listener net.Listener) net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	for _, multiple := range []int64{0, 1, 2, 5} {
+		// Any multiple of n gets in without the password
+		assert.NoError(t, srpZeroKeyLogin(dial(listener), params, "alice@example.com", multiple), multiple)
+
+		// Unless the server checks for it
+		err := srpZeroKeyLogin(dial(hardenedListener), params, "alice@example.com", multiple)
+		assert.Equal(t, errSRPAuthenticationFailed, err, multiple)
+	}
+
+	// Honest clients still get into the hardened server
+	client := newSRPClient(params, "alice@example.com", password)
+	assert.NoError(t, client.login(dial(hardenedListener)))
+}
+
+func TestChallenge38(t *testing.T) {
+	params := newSRPParams(dh.RFC3526Group1536)
+	password := "yellowsubmarine123"
+
+	// The simplified protocol works against a real server
+	server := newSRPServer(params)
+	server.simplified = true
+	server.register("alice@example.com", password)
+
+	client := newSRPClient(params, "alice@example.com", password)
+	client.simplified = true
+	assert.NoError(t, srpLoginOver(t, startSRPServer(t, server), client))
+
+	// A fake server gets the client to reveal enough to crack its password offline
+	mitm := &srpSimplifiedMITM{params: params}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		mitm.serveConn(conn)
+	}()
+
+	assert.Equal(t, errSRPAuthenticationFailed, srpLoginOver(t, listener, client))
+	if !assert.Len(t, mitm.captures, 1) {
+		return
+	}
+
+	cracked, err := crackSimplifiedSRP(params, mitm.captures[0], "data/38.txt", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, password, cracked)
+
+	// Passwords outside the wordlist survive
+	capture := mitm.captures[0]
+	capture.MAC = srpSimplifiedMITMProof(params, capture, "not a dictionary word")
+	_, err = crackSimplifiedSRP(params, capture, "data/38.txt", 4)
+	assert.Error(t, err)
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"runtime"
+	"sync"
+
+	"github.com/tyler-smith/matasano-cryptopals/dh"
+)
+
+// errSRPAuthenticationFailed is all an SRP server tells a client which couldn't
+// prove it knows the password, whatever the reason
+var errSRPAuthenticationFailed = errors.New("Authentication failed")
+
+// srpParams are the values client and server agree on up front: the group's
+// prime n and generator g, and the multiplier k = H(n | PAD(g)) from SRP-6a
+type srpParams struct {
+	n *big.Int
+	g *big.Int
+	k *big.Int
+}
+
+// newSRPParams returns the SRP parameters for a DH group
+func newSRPParams(group *dh.Group) *srpParams {
+	params := &srpParams{n: group.P, g: group.G}
+	params.k = params.hash(params.n.Bytes(), params.pad(params.g))
+
+	return params
+}
+
+// pad returns the value as big endian bytes, left padded to the length of n.
+// Values too big to fit are left as they are
+func (p *srpParams) pad(value *big.Int) []byte {
+	length := (p.n.BitLen() + 7) / 8
+	if (value.BitLen()+7)/8 > length {
+		return value.Bytes()
+	}
+
+	return value.FillBytes(make([]byte, length))
+}
+
+// hash returns the SHA-256 of the concatenated values as an integer
+func (p *srpParams) hash(values ...[]byte) *big.Int {
+	h := sha256.New()
+	for _, value := range values {
+		h.Write(value)
+	}
+
+	return new(big.Int).SetBytes(h.Sum(nil))
+}
+
+// privateKey returns x = H(salt | password)
+func (p *srpParams) privateKey(salt []byte, password string) *big.Int {
+	return p.hash(salt, []byte(password))
+}
+
+// scrambler returns u = H(PAD(A) | PAD(B))
+func (p *srpParams) scrambler(clientPublic *big.Int, serverPublic *big.Int) *big.Int {
+	return p.hash(p.pad(clientPublic), p.pad(serverPublic))
+}
+
+// sessionKey returns K = H(S)
+func (p *srpParams) sessionKey(secret *big.Int) []byte {
+	digest := sha256.Sum256(secret.Bytes())
+	return digest[:]
+}
+
+// randomExponent returns a random private exponent in [1, n)
+func (p *srpParams) randomExponent() (*big.Int, error) {
+	exponent, err := rand.Int(rand.Reader, new(big.Int).Sub(p.n, big.NewInt(1)))
+	if err != nil {
+		return nil, err
+	}
+
+	return exponent.Add(exponent, big.NewInt(1)), nil
+}
+
+// srpProof returns the HMAC-SHA256 of the salt keyed with the session key, which
+// the client sends to prove it has the same key as the server
+func srpProof(key []byte, salt []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	return mac.Sum(nil)
+}
+
+// Messages exchanged by the client and server, in order. Each goes over the
+// connection as a line of JSON
+type (
+	srpHello struct {
+		Identity string
+		A        *big.Int
+	}
+
+	srpChallenge struct {
+		Salt []byte
+		B    *big.Int
+		U    *big.Int `json:",omitempty"`
+	}
+
+	srpProofMessage struct {
+		MAC []byte
+	}
+
+	srpResult struct {
+		OK bool
+	}
+)
+
+// srpClient is the client's side of an SRP login. A simplified client speaks
+// the variant where the server sends u and B = g^b, leaving out k*v
+type srpClient struct {
+	params     *srpParams
+	identity   string
+	password   string
+	simplified bool
+
+	private *big.Int
+	public  *big.Int
+	key     []byte
+}
+
+func newSRPClient(params *srpParams, identity string, password string) *srpClient {
+	return &srpClient{params: params, identity: identity, password: password}
+}
+
+// hello starts a login by picking a private value a and sending A = g^a mod n
+func (c *srpClient) hello() (srpHello, error) {
+	private, err := c.params.randomExponent()
+	if err != nil {
+		return srpHello{}, err
+	}
+
+	c.private = private
+	c.public = new(big.Int).Exp(c.params.g, private, c.params.n)
+
+	return srpHello{Identity: c.identity, A: c.public}, nil
+}
+
+// respond computes the session key from the server's challenge and returns the
+// proof of it: S = (B - k*g^x)^(a + u*x) mod n, or S = B^(a + u*x) mod n when
+// simplified
+func (c *srpClient) respond(challenge srpChallenge) (srpProofMessage, error) {
+	p := c.params
+
+	if challenge.B == nil || new(big.Int).Mod(challenge.B, p.n).Sign() == 0 {
+		return srpProofMessage{}, errors.New("Server sent an invalid public value")
+	}
+
+	u := challenge.U
+	if !c.simplified {
+		u = p.scrambler(c.public, challenge.B)
+	}
+	if u == nil || u.Sign() == 0 {
+		return srpProofMessage{}, errors.New("Scrambler is zero")
+	}
+
+	x := p.privateKey(challenge.Salt, c.password)
+
+	base := challenge.B
+	if !c.simplified {
+		base = new(big.Int).Exp(p.g, x, p.n)
+		base.Mul(base, p.k)
+		base.Sub(challenge.B, base)
+		base.Mod(base, p.n)
+	}
+
+	exponent := new(big.Int).Mul(u, x)
+	exponent.Add(exponent, c.private)
+
+	c.key = p.sessionKey(new(big.Int).Exp(base, exponent, p.n))
+
+	return srpProofMessage{MAC: srpProof(c.key, challenge.Salt)}, nil
+}
+
+// srpVerifier is what the server stores for a user instead of the password
+type srpVerifier struct {
+	salt     []byte
+	verifier *big.Int
+}
+
+// srpServer keeps the users' verifiers and starts a session for each login. Users
+// must all be registered before the server starts taking logins. A hardened
+// server rejects client public values which are 0 mod n. A simplified server
+// speaks the variant where u is random and B = g^b
+type srpServer struct {
+	params     *srpParams
+	users      map[string]srpVerifier
+	hardened   bool
+	simplified bool
+}
+
+func newSRPServer(params *srpParams) *srpServer {
+	return &srpServer{params: params, users: map[string]srpVerifier{}}
+}
+
+// register stores a salt and the verifier v = g^x mod n for the user
+func (s *srpServer) register(identity string, password string) {
+	salt := randomBytes(16)
+	x := s.params.privateKey(salt, password)
+
+	s.users[identity] = srpVerifier{salt: salt, verifier: new(big.Int).Exp(s.params.g, x, s.params.n)}
+}
+
+// srpServerSession is the server's side of one login
+type srpServerSession struct {
+	params *srpParams
+	user   srpVerifier
+	key    []byte
+}
+
+// hello starts a session for the client, returning the salt and the server's
+// public value B = k*v + g^b mod n, or when simplified B = g^b mod n and a random
+// 128-bit u. The session key is S = (A * v^u)^b mod n
+func (s *srpServer) hello(hello srpHello) (*srpServerSession, srpChallenge, error) {
+	p := s.params
+
+	user, ok := s.users[hello.Identity]
+	if !ok || hello.A == nil {
+		return nil, srpChallenge{}, errSRPAuthenticationFailed
+	}
+
+	// A = 0 mod n makes the session key H(0) whatever the password
+	if s.hardened && new(big.Int).Mod(hello.A, p.n).Sign() == 0 {
+		return nil, srpChallenge{}, errSRPAuthenticationFailed
+	}
+
+	private, err := p.randomExponent()
+	if err != nil {
+		return nil, srpChallenge{}, err
+	}
+
+	challenge := srpChallenge{Salt: user.salt}
+	var u *big.Int
+
+	if s.simplified {
+		challenge.B = new(big.Int).Exp(p.g, private, p.n)
+		u = new(big.Int).SetBytes(randomBytes(16))
+		challenge.U = u
+	} else {
+		challenge.B = new(big.Int).Mul(p.k, user.verifier)
+		challenge.B.Add(challenge.B, new(big.Int).Exp(p.g, private, p.n))
+		challenge.B.Mod(challenge.B, p.n)
+		u = p.scrambler(hello.A, challenge.B)
+	}
+
+	secret := new(big.Int).Exp(user.verifier, u, p.n)
+	secret.Mul(secret, hello.A)
+	secret.Exp(secret, private, p.n)
+
+	session := &srpServerSession{params: p, user: user, key: p.sessionKey(secret)}
+	return session, challenge, nil
+}
+
+// verify checks the client's proof of the session key
+func (s *srpServerSession) verify(proof srpProofMessage) error {
+	if !hmac.Equal(proof.MAC, srpProof(s.key, s.user.salt)) {
+		return errSRPAuthenticationFailed
+	}
+
+	return nil
+}
+
+// serve accepts connections from the listener and handles each login in its own
+// goroutine until the listener is closed
+func (s *srpServer) serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// serveConn runs one login over the connection, telling the client whether it
+// succeeded
+func (s *srpServer) serveConn(conn net.Conn) error {
+	decoder := json.NewDecoder(conn)
+	encoder := json.NewEncoder(conn)
+
+	var hello srpHello
+	if err := decoder.Decode(&hello); err != nil {
+		return err
+	}
+
+	session, challenge, err := s.hello(hello)
+	if err != nil {
+		encoder.Encode(srpResult{OK: false})
+		return err
+	}
+	if err := encoder.Encode(challenge); err != nil {
+		return err
+	}
+
+	var proof srpProofMessage
+	if err := decoder.Decode(&proof); err != nil {
+		return err
+	}
+
+	err = session.verify(proof)
+	if encodeErr := encoder.Encode(srpResult{OK: err == nil}); encodeErr != nil {
+		return encodeErr
+	}
+
+	return err
+}
+
+// srpClientConn is the client's end of the transport. It carries the protocol
+// messages without caring how they were made
+type srpClientConn struct {
+	encoder *json.Encoder
+	decoder *json.Decoder
+}
+
+func newSRPClientConn(conn net.Conn) *srpClientConn {
+	return &srpClientConn{encoder: json.NewEncoder(conn), decoder: json.NewDecoder(conn)}
+}
+
+// hello sends the hello and returns the server's challenge. A server which
+// rejects the hello answers with a failed result instead
+func (c *srpClientConn) hello(hello srpHello) (srpChallenge, error) {
+	if err := c.encoder.Encode(hello); err != nil {
+		return srpChallenge{}, err
+	}
+
+	var reply struct {
+		srpChallenge
+		OK *bool
+	}
+	if err := c.decoder.Decode(&reply); err != nil {
+		return srpChallenge{}, err
+	}
+	if reply.OK != nil {
+		return srpChallenge{}, errSRPAuthenticationFailed
+	}
+
+	return reply.srpChallenge, nil
+}
+
+// proof sends the proof and returns errSRPAuthenticationFailed if the server
+// rejects it
+func (c *srpClientConn) proof(proof srpProofMessage) error {
+	if err := c.encoder.Encode(proof); err != nil {
+		return err
+	}
+
+	var result srpResult
+	if err := c.decoder.Decode(&result); err != nil {
+		return fmt.Errorf("reading result: %w", err)
+	}
+	if !result.OK {
+		return errSRPAuthenticationFailed
+	}
+
+	return nil
+}
+
+// login runs the client's side of a login over the connection. It returns
+// errSRPAuthenticationFailed if the server rejects it
+func (c *srpClient) login(conn net.Conn) error {
+	transport := newSRPClientConn(conn)
+
+	hello, err := c.hello()
+	if err != nil {
+		return err
+	}
+
+	challenge, err := transport.hello(hello)
+	if err != nil {
+		return err
+	}
+
+	proof, err := c.respond(challenge)
+	if err != nil {
+		return err
+	}
+
+	return transport.proof(proof)
+}
+
+// srpZeroKeyLogin logs in as the user without knowing their password by sending
+// A = multiple * n. The server's secret is then (A * v^u)^b mod n = 0, so the
+// session key is H(0)
+func srpZeroKeyLogin(conn net.Conn, params *srpParams, identity string, multiple int64) error {
+	transport := newSRPClientConn(conn)
+
+	public := new(big.Int).Mul(big.NewInt(multiple), params.n)
+	challenge, err := transport.hello(srpHello{Identity: identity, A: public})
+	if err != nil {
+		return err
+	}
+
+	key := params.sessionKey(big.NewInt(0))
+	return transport.proof(srpProofMessage{MAC: srpProof(key, challenge.Salt)})
+}
+
+// srpCapture is what a fake simplified SRP server learns from a client's login
+type srpCapture struct {
+	A   *big.Int
+	MAC []byte
+}
+
+// srpSimplifiedMITM poses as a simplified SRP server. It answers every hello with
+// b = 1, u = 1 and an empty salt, which leaves the client's proof depending on
+// nothing but A, which we see, and the password. Then it turns the client away
+type srpSimplifiedMITM struct {
+	params *srpParams
+
+	mu       sync.Mutex
+	captures []srpCapture
+}
+
+// serveConn fakes one login over the connection
+func (m *srpSimplifiedMITM) serveConn(conn net.Conn) error {
+	decoder := json.NewDecoder(conn)
+	encoder := json.NewEncoder(conn)
+
+	var hello srpHello
+	if err := decoder.Decode(&hello); err != nil {
+		return err
+	}
+	if hello.A == nil {
+		return encoder.Encode(srpResult{OK: false})
+	}
+
+	challenge := srpChallenge{Salt: []byte{}, B: m.params.g, U: big.NewInt(1)}
+	if err := encoder.Encode(challenge); err != nil {
+		return err
+	}
+
+	var proof srpProofMessage
+	if err := decoder.Decode(&proof); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.captures = append(m.captures, srpCapture{A: hello.A, MAC: proof.MAC})
+	m.mu.Unlock()
+
+	return encoder.Encode(srpResult{OK: false})
+}
+
+// srpSimplifiedMITMProof returns the proof a client would send the MITM if its
+// password were the given one. With b = 1 and u = 1 the server's secret is
+// S = A * v mod n
+func srpSimplifiedMITMProof(params *srpParams, capture srpCapture, password string) []byte {
+	x := params.privateKey([]byte{}, password)
+	v := new(big.Int).Exp(params.g, x, params.n)
+
+	secret := new(big.Int).Mul(capture.A, v)
+	secret.Mod(secret, params.n)
+
+	return srpProof(params.sessionKey(secret), []byte{})
+}
+
+// crackSimplifiedSRP runs an offline dictionary attack on a login captured by
+// srpSimplifiedMITM, trying the words from the file over the given number of
+// workers (or one per CPU if 0)
+func crackSimplifiedSRP(params *srpParams, capture srpCapture, wordlistFile string, workers int) (string, error) {
+	lines, err := readLinesFile(wordlistFile, func(line string) ([]byte, error) { return []byte(line), nil })
+	if err != nil {
+		return "", err
+	}
+
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+
+	words := make(chan string)
+	done := make(chan struct{})
+
+	var (
+		once     sync.Once
+		password string
+		found    bool
+		wg       sync.WaitGroup
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for word := range words {
+				if hmac.Equal(srpSimplifiedMITMProof(params, capture, word), capture.MAC) {
+					once.Do(func() {
+						password, found = word, true
+						close(done)
+					})
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, line := range lines {
+		select {
+		case words <- string(line):
+		case <-done:
+			break feed
+		}
+	}
+	close(words)
+	wg.Wait()
+
+	if !found {
+		return "", errors.New("Password not in wordlist")
+	}
+
+	return password, nil
+}
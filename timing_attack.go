@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/tyler-smith/matasano-cryptopals/sha1"
+)
+
+// insecureCompare compares two byte slices one byte at a time, sleeping after
+// each matching byte and bailing out at the first difference. The time it takes
+// leaks how many leading bytes match
+func insecureCompare(a []byte, b []byte, delay time.Duration) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+		time.Sleep(delay)
+	}
+
+	return true
+}
+
+// newHMACTimingServer starts a loopback web service which accepts requests like
+// /test?file=foo&signature=46b4ec586117154dacd49d664e5d63fdc88efb51 and responds
+// 200 when the signature is the HMAC-SHA1 of the file name, or 500 otherwise.
+// Signatures are the first signatureLength bytes of the HMAC, from 1 to all 20
+// of them. The signature is checked with insecureCompare using the given
+// per-byte delay
+func newHMACTimingServer(key []byte, signatureLength int, delay time.Duration) (*httptest.Server, error) {
+	if signatureLength < 1 || signatureLength > sha1.Size {
+		return nil, fmt.Errorf("signature length %d out of range", signatureLength)
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		signature, err := hex.DecodeString(query.Get("signature"))
+		if err != nil {
+			http.Error(w, "Malformed signature", http.StatusBadRequest)
+			return
+		}
+
+		expected := HmacSha1(key, []byte(query.Get("file")))[:signatureLength]
+		if !insecureCompare(expected, signature, delay) {
+			http.Error(w, "Invalid signature", http.StatusInternalServerError)
+			return
+		}
+
+		io.WriteString(w, "OK")
+	})), nil
+}
+
+// hmacTimingClient makes signed requests for a file and measures how long the
+// server takes to respond
+type hmacTimingClient struct {
+	client  *http.Client
+	baseURL string
+	file    string
+}
+
+// request sends the signature and returns the response status and duration
+func (c *hmacTimingClient) request(signature []byte) (int, time.Duration, error) {
+	query := url.Values{
+		"file":      []string{c.file},
+		"signature": []string{hex.EncodeToString(signature)},
+	}
+
+	start := time.Now()
+	resp, err := c.client.Get(c.baseURL + "/test?" + query.Encode())
+	if err != nil {
+		return 0, 0, err
+	}
+	elapsed := time.Since(start)
+
+	// Drain the body so the connection is reused for the next request
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	return resp.StatusCode, elapsed, nil
+}
+
+// sampleTimes appends the response times for the signature over the given
+// number of samples to timings
+func (c *hmacTimingClient) sampleTimes(signature []byte, samples int, timings []float64) ([]float64, error) {
+	for i := 0; i < samples; i++ {
+		_, elapsed, err := c.request(signature)
+		if err != nil {
+			return nil, err
+		}
+		timings = append(timings, float64(elapsed))
+	}
+
+	return timings, nil
+}
+
+// medianTime returns the median of the timings. The median keeps scheduling
+// hiccups from skewing results
+func medianTime(timings []float64) float64 {
+	sorted := append([]float64{}, timings...)
+	sort.Float64s(sorted)
+
+	return sorted[len(sorted)/2]
+}
+
+const (
+	// hmacTimingQuickSamples is how many requests each value gets in the quick
+	// first pass. It doubles each time the byte is started over, since the odd
+	// slow response can push the right value off the shortlist
+	hmacTimingQuickSamples = 1
+
+	// hmacTimingShortlist is how many of the slowest candidates from a quick first
+	// pass are kept for careful measurement
+	hmacTimingShortlist = 16
+
+	// hmacTimingRounds limits how many times the shortlist is re-measured while
+	// waiting for a clear winner
+	hmacTimingRounds = 4
+
+	// hmacTimingAttempts limits how many times a byte is started over from the
+	// quick pass when the shortlist never produces a clear winner
+	hmacTimingAttempts = 3
+
+	// hmacTimingBacktracks limits how many times crackHMACTiming will back up to
+	// measure an earlier byte again
+	hmacTimingBacktracks = 64
+)
+
+// timingLevel sums up the quick pass over every value of one signature byte.
+// All but one value match exactly as many bytes as each other, so the median
+// is the time taken to reject the bytes before this one and hardly moves with
+// the noise. The spread is the interquartile range of their medians
+type timingLevel struct {
+	median float64
+	spread float64
+}
+
+// rose reports whether the level is clearly a byte's delay above the previous
+// one. A median over 256 values is good to a small fraction of the spread, so
+// a third of the spread is well clear of chance
+func (l timingLevel) rose(previous timingLevel) bool {
+	return l.median-previous.median > l.spread/3
+}
+
+// newTimingLevel returns the level for the quick pass over a byte
+func newTimingLevel(candidates []*timingCandidate) timingLevel {
+	timings := make([]float64, len(candidates))
+	for i, candidate := range candidates {
+		timings[i] = candidate.median
+	}
+	sort.Float64s(timings)
+
+	return timingLevel{
+		median: timings[len(timings)/2],
+		spread: timings[len(timings)*3/4] - timings[len(timings)/4],
+	}
+}
+
+// crackHMACTimingByte finds the value for signature[i] which makes the server
+// take the longest to reject the signature, along with the level of its quick
+// pass.
+//
+// A quick pass over every value narrows them down to a shortlist, then the
+// shortlist is measured again with `samples` requests apiece. The winner is
+// clear once its median is further ahead of the runner up than the runner up is
+// from the fastest of the shortlist, and further above the level than the level
+// spreads, i.e. it stands out from the noise. Until then more samples are taken,
+// and if that doesn't help we start over with a slower quick pass in case it
+// missed the right value
+func crackHMACTimingByte(client *hmacTimingClient, signature []byte, i int, samples int) (byte, timingLevel, error) {
+	var best *timingCandidate
+	var level timingLevel
+
+	for attempt := 0; attempt < hmacTimingAttempts; attempt++ {
+		shortlist := make([]*timingCandidate, 0, 256)
+		for value := 0; value < 256; value++ {
+			candidate := &timingCandidate{value: byte(value)}
+			if err := candidate.measure(client, signature, i, hmacTimingQuickSamples<<uint(attempt)); err != nil {
+				return 0, timingLevel{}, err
+			}
+			shortlist = append(shortlist, candidate)
+		}
+
+		level = newTimingLevel(shortlist)
+		sortTimingCandidates(shortlist)
+		shortlist = shortlist[len(shortlist)-hmacTimingShortlist:]
+
+		for round := 0; round < hmacTimingRounds; round++ {
+			// Take one sample from each candidate at a time, in a different order
+			// each time, so drift in the response times is shared out evenly
+			for sample := 0; sample < samples; sample++ {
+				for _, j := range rand.Perm(len(shortlist)) {
+					if err := shortlist[j].measure(client, signature, i, 1); err != nil {
+						return 0, timingLevel{}, err
+					}
+				}
+			}
+
+			sortTimingCandidates(shortlist)
+
+			last := len(shortlist) - 1
+			best = shortlist[last]
+			lead := best.median - shortlist[last-1].median
+			noise := shortlist[last-1].median - shortlist[0].median
+			if lead > noise && best.median-level.median > level.spread {
+				return best.value, level, nil
+			}
+		}
+	}
+
+	// Never got a clear winner so go with the best we have
+	return best.value, level, nil
+}
+
+// timingCandidate holds the response times seen for one value of a signature byte
+type timingCandidate struct {
+	value   byte
+	timings []float64
+	median  float64
+}
+
+// measure takes more samples for the candidate at position i of the signature
+func (c *timingCandidate) measure(client *hmacTimingClient, signature []byte, i int, samples int) error {
+	var err error
+
+	signature[i] = c.value
+	c.timings, err = client.sampleTimes(signature, samples, c.timings)
+	if err != nil {
+		return err
+	}
+
+	c.median = medianTime(c.timings)
+	return nil
+}
+
+// sortTimingCandidates sorts candidates from fastest to slowest median time
+func sortTimingCandidates(candidates []*timingCandidate) {
+	sort.Slice(candidates, func(a, b int) bool { return candidates[a].median < candidates[b].median })
+}
+
+// crackHMACTimingLastByte tries every value for the final byte of the signature,
+// since the server tells us outright when it's right. It reports whether any
+// value was accepted
+func crackHMACTimingLastByte(client *hmacTimingClient, signature []byte) (bool, error) {
+	last := len(signature) - 1
+	for candidate := 0; candidate < 256; candidate++ {
+		signature[last] = byte(candidate)
+		status, _, err := client.request(signature)
+		if err != nil {
+			return false, err
+		}
+		if status == http.StatusOK {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// crackHMACTiming recovers a valid signature of signatureLength bytes for the
+// file from a server which leaks the number of matching signature bytes through
+// its response time. Each byte is found with crackHMACTimingByte, apart from the
+// final byte which is found by trying them all.
+//
+// A wrong byte can still win on noise. When it does, the values for the next
+// byte take no longer to reject than the ones before, and no final byte is ever
+// accepted. Either way we back up and measure the byte before again
+func crackHMACTiming(baseURL string, file string, signatureLength int, samples int) ([]byte, error) {
+	if signatureLength < 1 {
+		return nil, fmt.Errorf("signature length %d must be at least 1", signatureLength)
+	}
+
+	client := &hmacTimingClient{client: &http.Client{}, baseURL: baseURL, file: file}
+	signature := make([]byte, signatureLength)
+	last := signatureLength - 1
+
+	levels := make([]timingLevel, signatureLength)
+	backtracks := 0
+
+	for i := 0; ; {
+		var ok bool
+		if i == last {
+			var err error
+			ok, err = crackHMACTimingLastByte(client, signature)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			b, level, err := crackHMACTimingByte(client, signature, i, samples)
+			if err != nil {
+				return nil, err
+			}
+			signature[i] = b
+			levels[i] = level
+			ok = i == 0 || level.rose(levels[i-1])
+		}
+
+		switch {
+		case ok && i == last:
+			return signature, nil
+		case ok:
+			i++
+		case i == 0 || backtracks == hmacTimingBacktracks:
+			return nil, errors.New("Could not find a valid signature")
+		default:
+			backtracks++
+			i--
+		}
+	}
+}
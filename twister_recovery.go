@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+var (
+	// errTwisterUnderdetermined means the observations don't pin down the state
+	errTwisterUnderdetermined = errors.New("Not enough observations to recover the twister")
+
+	// errTwisterInconsistent means no state could have produced the observations
+	errTwisterInconsistent = errors.New("Observations are inconsistent with any twister state")
+)
+
+// twisterObservation is one output of a twister. Only the bits set in mask are
+// known; a mask of 0 marks an output which was skipped
+type twisterObservation struct {
+	value uint64
+	mask  uint64
+}
+
+// gf2System is a system of linear equations over GF(2) kept in row echelon form.
+// Each row's pivot is its lowest set bit
+type gf2System struct {
+	words  int
+	pivots [][]uint64
+	rhs    []uint64
+	rank   int
+}
+
+func newGF2System(variables int) *gf2System {
+	return &gf2System{
+		words:  (variables + 63) / 64,
+		pivots: make([][]uint64, variables),
+		rhs:    make([]uint64, variables),
+	}
+}
+
+// add reduces the equation row·x = rhs against the system and keeps it if it's
+// independent. row is modified. It returns the new pivot column, or -1 if the
+// equation was already implied by the system
+func (s *gf2System) add(row []uint64, rhs uint64) (int, error) {
+	for w := 0; w < s.words; w++ {
+		for row[w] != 0 {
+			column := w*64 + bits.TrailingZeros64(row[w])
+
+			pivot := s.pivots[column]
+			if pivot == nil {
+				s.pivots[column] = row
+				s.rhs[column] = rhs
+				s.rank++
+				return column, nil
+			}
+
+			for i := w; i < s.words; i++ {
+				row[i] ^= pivot[i]
+			}
+			rhs ^= s.rhs[column]
+		}
+	}
+
+	if rhs != 0 {
+		return -1, errTwisterInconsistent
+	}
+
+	return -1, nil
+}
+
+// solve returns the solution of a full rank system by back substitution
+func (s *gf2System) solve() []uint64 {
+	solution := make([]uint64, s.words)
+
+	for column := len(s.pivots) - 1; column >= 0; column-- {
+		row := s.pivots[column]
+
+		parity := s.rhs[column]
+		for w := column / 64; w < s.words; w++ {
+			parity ^= uint64(bits.OnesCount64(row[w]&solution[w]) & 1)
+		}
+
+		solution[column/64] |= parity << (column % 64)
+	}
+
+	return solution
+}
+
+// recoverTwister rebuilds a twister from its outputs, even when most of each
+// output is unknown, and returns it ready to predict the output after the last
+// observation.
+//
+// The words behind N consecutive outputs make up the whole state, so their bits
+// are our unknowns. Twisting and tempering are both linear over GF(2), so every
+// known bit of every output, however far along, is the XOR of some of those
+// unknowns. Enough of them give a system we can solve. The low R bits of the
+// first word never reach the future outputs so they don't need to be known
+func recoverTwister(params TwisterParams, observations []twisterObservation) (*Twister, error) {
+	n, w, r := int(params.N), int(params.W), int(params.R)
+	variables := n * w
+	system := newGF2System(variables)
+
+	// tempering[j] has bit k set when output bit j depends on state bit k
+	tempering := make([]uint64, w)
+	for k := 0; k < w; k++ {
+		column := params.temper(1 << uint(k))
+		for j := 0; j < w; j++ {
+			tempering[j] |= (column >> uint(j) & 1) << uint(k)
+		}
+	}
+
+	// words holds the symbolic state words for the last N outputs, each bit as the
+	// set of unknowns it's the XOR of
+	words := make([][][]uint64, n)
+	for t := range words {
+		words[t] = make([][]uint64, w)
+		for j := range words[t] {
+			words[t][j] = make([]uint64, system.words)
+			unknown := t*w + j
+			words[t][j][unknown/64] |= 1 << uint(unknown%64)
+		}
+	}
+
+	// Once every unknown other than the first word's low bits has a pivot the
+	// rest of the observations add nothing
+	needed := variables - r
+	pivoted := 0
+
+	for t, observation := range observations {
+		if pivoted == needed {
+			break
+		}
+
+		if t >= n {
+			twistSymbolic(&params, words, t)
+		}
+
+		word := words[t%n]
+		for j := 0; j < w; j++ {
+			if observation.mask>>uint(j)&1 == 0 {
+				continue
+			}
+
+			row := make([]uint64, system.words)
+			for k := 0; k < w; k++ {
+				if tempering[j]>>uint(k)&1 == 1 {
+					for i := range row {
+						row[i] ^= word[k][i]
+					}
+				}
+			}
+
+			column, err := system.add(row, observation.value>>uint(j)&1)
+			if err != nil {
+				return nil, err
+			}
+			if column >= r {
+				pivoted++
+			}
+		}
+	}
+
+	// Any of the first word's low bits that are still unknown don't matter so
+	// call them 0. Ones the observations already fix just come out inconsistent
+	// with that and are left alone
+	for j := 0; j < r; j++ {
+		row := make([]uint64, system.words)
+		row[j/64] |= 1 << uint(j%64)
+		system.add(row, 0)
+	}
+
+	if system.rank < variables {
+		return nil, fmt.Errorf("%w: %d of %d state bits unknown", errTwisterUnderdetermined, variables-system.rank, variables)
+	}
+
+	solution := system.solve()
+	state := make([]uint64, n)
+	for t := range state {
+		for j := 0; j < w; j++ {
+			unknown := t*w + j
+			state[t] |= (solution[unknown/64] >> uint(unknown%64) & 1) << uint(j)
+		}
+	}
+
+	// The solved words are the first N outputs. Run the twister on from there to
+	// the end of the observations
+	mt, err := NewTwisterFromState(params, state, 0)
+	if err != nil {
+		return nil, err
+	}
+	for range observations {
+		mt.next()
+	}
+
+	return mt, nil
+}
+
+// recoverMT19937FromKeystream clones the twister behind calculateMT19937 from a
+// stretch of its keystream, which only shows the low byte of each output. It
+// takes around 5000 bytes
+func recoverMT19937FromKeystream(keystream []byte) (*MT19937, error) {
+	observations := make([]twisterObservation, len(keystream))
+	for i, b := range keystream {
+		observations[i] = twisterObservation{value: uint64(b), mask: 0xff}
+	}
+
+	twister, err := recoverTwister(MT19937Params, observations)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MT19937{twister: *twister}, nil
+}
+
+// twistSymbolic replaces the symbolic word for output t-N with the one for
+// output t, following the same recurrence as Twister.twist
+func twistSymbolic(params *TwisterParams, words [][][]uint64, t int) {
+	n, w := int(params.N), int(params.W)
+
+	first := words[(t-n)%n]
+	second := words[(t-n+1)%n]
+	middle := words[(t-n+int(params.M))%n]
+
+	// y takes its upper bits from the first word and the lower R from the second
+	y := func(j int) []uint64 {
+		if uint(j) >= params.R {
+			return first[j]
+		}
+		return second[j]
+	}
+
+	next := make([][]uint64, w)
+	for j := 0; j < w; j++ {
+		bit := append([]uint64{}, middle[j]...)
+
+		if j+1 < w {
+			for i, value := range y(j + 1) {
+				bit[i] ^= value
+			}
+		}
+		if params.A>>uint(j)&1 == 1 {
+			for i, value := range y(0) {
+				bit[i] ^= value
+			}
+		}
+
+		next[j] = bit
+	}
+
+	words[t%n] = next
+}
@@ -5,13 +5,159 @@ import (
 	crand "crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/url"
 	"os"
+	"sync"
+)
+
+// Sentinel errors returned by the helpers. Errors may be wrapped with more
+// detail so compare them with errors.Is
+var (
+	ErrInvalidPadding     = errors.New("invalid padding")
+	ErrInvalidKeySize     = errors.New("invalid key size")
+	ErrInvalidEncoding    = errors.New("invalid encoding")
+	ErrInvalidBlockLength = errors.New("input is not a multiple of the block size")
+
+	// ErrOracleBudgetExceeded is wrapped by the *oracleBudgetError attacks
+	// return when they run out of oracle queries
+	ErrOracleBudgetExceeded = errors.New("oracle query budget exceeded")
 )
 
 type oracleFunc func([]byte) []byte
 
+// fallibleOracleFunc is an oracleFunc which may fail to give an answer
+type fallibleOracleFunc func([]byte) ([]byte, error)
+
+// oracleStats holds counts of oracle queries and the bytes sent and received
+type oracleStats struct {
+	queries  int
+	bytesIn  int
+	bytesOut int
+}
+
+func (s *oracleStats) add(queries int, bytesIn int, bytesOut int) {
+	s.queries += queries
+	s.bytesIn += bytesIn
+	s.bytesOut += bytesOut
+}
+
+// oracleBudgetError is returned by attacks which ran out of oracle queries
+type oracleBudgetError struct {
+	budget int
+	phase  string
+}
+
+func (e *oracleBudgetError) Error() string {
+	return fmt.Sprintf("oracle query budget of %d exceeded during %q", e.budget, e.phase)
+}
+
+func (e *oracleBudgetError) Unwrap() error {
+	return ErrOracleBudgetExceeded
+}
+
+// oracleMeter keeps track of how an attack uses its oracle, both in total and
+// per named phase of the attack. A budget greater than 0 limits the number of
+// queries; going over it fails the attack with an *oracleBudgetError. A nil
+// *oracleMeter is valid and simply doesn't record anything. It's safe for use by
+// concurrent attacks
+type oracleMeter struct {
+	mu     sync.Mutex
+	budget int
+	phase  string
+	total  oracleStats
+	phases map[string]*oracleStats
+}
+
+func newOracleMeter(budget int) *oracleMeter {
+	return &oracleMeter{budget: budget, phases: map[string]*oracleStats{}}
+}
+
+// setPhase attributes all following queries to the given phase
+func (m *oracleMeter) setPhase(phase string) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.phase = phase
+}
+
+// spend records a query sending the given number of bytes. If it would exceed the
+// budget it returns an *oracleBudgetError instead and the query must not be made
+func (m *oracleMeter) spend(bytesIn int) error {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.budget > 0 && m.total.queries >= m.budget {
+		return &oracleBudgetError{budget: m.budget, phase: m.phase}
+	}
+
+	m.total.add(1, bytesIn, 0)
+	m.phaseStats(m.phase).add(1, bytesIn, 0)
+
+	return nil
+}
+
+// received records the size of the oracle's answer to the last query
+func (m *oracleMeter) received(bytesOut int) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.total.add(0, 0, bytesOut)
+	m.phaseStats(m.phase).add(0, 0, bytesOut)
+}
+
+// stats returns the stats for a phase, or for all queries if phase is empty
+func (m *oracleMeter) stats(phase string) oracleStats {
+	if m == nil {
+		return oracleStats{}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if phase == "" {
+		return m.total
+	}
+
+	return *m.phaseStats(phase)
+}
+
+func (m *oracleMeter) phaseStats(phase string) *oracleStats {
+	stats, ok := m.phases[phase]
+	if !ok {
+		stats = &oracleStats{}
+		m.phases[phase] = stats
+	}
+	return stats
+}
+
+// wrap returns an oracle which records every call to oracle with the meter, and
+// fails without calling it once the budget is spent
+func (m *oracleMeter) wrap(oracle oracleFunc) fallibleOracleFunc {
+	return func(message []byte) ([]byte, error) {
+		if err := m.spend(len(message)); err != nil {
+			return nil, err
+		}
+		cipher := oracle(message)
+		m.received(len(cipher))
+		return cipher, nil
+	}
+}
+
 // tuple is a container for a value/sort-item pair
 type tuple struct {
 	val        int
@@ -32,12 +178,23 @@ func (l tupleSortList) Less(i int, j int) bool { return l[i].measurable < l[j].m
 
 // hexToBase64 converts a string with hex encoding to one with base64 encoding
 func hexToBase64(hexString string) string {
-	return base64.StdEncoding.EncodeToString(hexToBytes(hexString))
+	return base64.StdEncoding.EncodeToString(mustHexToBytes(hexString))
 }
 
-// hexToBytes decodes a string with hex encoding and returns a byte slice for the underlying data
-func hexToBytes(hexString string) []byte {
+// hexToBytes decodes a string with hex encoding and returns a byte slice for the
+// underlying data, or ErrInvalidEncoding for bad input
+func hexToBytes(hexString string) ([]byte, error) {
 	bytes, err := hex.DecodeString(hexString)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
+	}
+
+	return bytes, nil
+}
+
+// mustHexToBytes is like hexToBytes but panics on error
+func mustHexToBytes(hexString string) []byte {
+	bytes, err := hexToBytes(hexString)
 	if err != nil {
 		panic(err)
 	}
@@ -45,13 +202,25 @@ func hexToBytes(hexString string) []byte {
 	return bytes
 }
 
-func base64ToBytes(base64str string) []byte {
+// base64ToBytes decodes a string with base64 encoding, returning
+// ErrInvalidEncoding for bad input
+func base64ToBytes(base64str string) ([]byte, error) {
 	bytes, err := base64.StdEncoding.DecodeString(base64str)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
+	}
+
+	return bytes, nil
+}
+
+// mustBase64ToBytes is like base64ToBytes but panics on error
+func mustBase64ToBytes(base64str string) []byte {
+	bytes, err := base64ToBytes(base64str)
 	if err != nil {
 		panic(err)
 	}
-	return bytes
 
+	return bytes
 }
 
 func randomBytes(size int) []byte {
@@ -111,52 +280,133 @@ func englishScore(str []byte) float64 {
 	return letterCount / nonLetterCount
 }
 
+// englishLetterFrequencies holds the relative frequency (in percent) of each
+// lowercase letter in English text
+var englishLetterFrequencies = map[byte]float64{
+	'a': 8.167, 'b': 1.492, 'c': 2.782, 'd': 4.253, 'e': 12.702, 'f': 2.228,
+	'g': 2.015, 'h': 6.094, 'i': 6.966, 'j': 0.153, 'k': 0.772, 'l': 4.025,
+	'm': 2.406, 'n': 6.749, 'o': 7.507, 'p': 1.929, 'q': 0.095, 'r': 5.987,
+	's': 6.327, 't': 9.056, 'u': 2.758, 'v': 0.978, 'w': 2.360, 'x': 0.150,
+	'y': 1.974, 'z': 0.074,
+}
+
+// englishCharacterScore weighs a single character by how likely it is to show
+// up in English text. Non-printable characters score 0
+func englishCharacterScore(c byte) float64 {
+	switch {
+	case c == ' ':
+		return 15
+	case c >= 'a' && c <= 'z':
+		return englishLetterFrequencies[c]
+	case c >= 'A' && c <= 'Z':
+		// Capitals are less common than their lowercase counterparts
+		return englishLetterFrequencies[c+'a'-'A'] / 4
+	case c == ',' || c == '.' || c == '\'' || c == '-' || c == ';' || c == ':' || c == '!' || c == '?':
+		return 1
+	case c >= 0x20 && c < 0x7f:
+		return 0.1
+	}
+
+	return 0
+}
+
+// englishFrequencyScore scores how "english-like" a byte slice is by its
+// character frequencies. Every non-printable character cuts the score by 90%
+func englishFrequencyScore(str []byte) float64 {
+	score := float64(0)
+	penalty := float64(1)
+
+	for _, c := range str {
+		charScore := englishCharacterScore(c)
+		if charScore == 0 {
+			penalty *= 0.1
+		}
+		score += charScore
+	}
+
+	return score * penalty
+}
+
 // readBase64File reads in a file by the given name and returns a byte slice of
-// it's contents decoded as base64
-func readBase64File(filename string) []byte {
+// it's contents decoded as base64, or any file or decoding error
+func readBase64File(filename string) ([]byte, error) {
 	rawContents, err := ioutil.ReadFile(filename)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	return base64ToBytes(string(rawContents))
 }
 
-// readBase64SliceFile reads in a file by the given name and returns a slice of each line decoded as base64
-func readBase64SliceFile(filename string) [][]byte {
-	inFile, _ := os.Open(filename)
-	defer inFile.Close()
-	scanner := bufio.NewScanner(inFile)
-	scanner.Split(bufio.ScanLines)
+// mustReadBase64File is like readBase64File but panics on error
+func mustReadBase64File(filename string) []byte {
+	contents, err := readBase64File(filename)
+	if err != nil {
+		panic(err)
+	}
 
-	contents := [][]byte{}
-	for scanner.Scan() {
-		rawContent := scanner.Text()
-		contents = append(contents, base64ToBytes(rawContent))
+	return contents
+}
+
+// readBase64SliceFile reads in a file by the given name and returns a slice of
+// each line decoded as base64, or any file or decoding error
+func readBase64SliceFile(filename string) ([][]byte, error) {
+	return readLinesFile(filename, base64ToBytes)
+}
+
+// mustReadBase64SliceFile is like readBase64SliceFile but panics on error
+func mustReadBase64SliceFile(filename string) [][]byte {
+	contents, err := readBase64SliceFile(filename)
+	if err != nil {
+		panic(err)
 	}
 
 	return contents
 }
 
-// readHexSliceFile reads in a file by the given name and returns a slice of each line decoded as hex
-func readHexSliceFile(filename string) [][]byte {
-	inFile, _ := os.Open(filename)
+// readHexSliceFile reads in a file by the given name and returns a slice of each
+// line decoded as hex, or any file or decoding error
+func readHexSliceFile(filename string) ([][]byte, error) {
+	return readLinesFile(filename, hexToBytes)
+}
+
+// mustReadHexSliceFile is like readHexSliceFile but panics on error
+func mustReadHexSliceFile(filename string) [][]byte {
+	contents, err := readHexSliceFile(filename)
+	if err != nil {
+		panic(err)
+	}
+
+	return contents
+}
+
+// readLinesFile reads in a file by the given name and returns a slice of each line
+// decoded with the given function
+func readLinesFile(filename string, decode func(string) ([]byte, error)) ([][]byte, error) {
+	inFile, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
 	defer inFile.Close()
+
 	scanner := bufio.NewScanner(inFile)
 	scanner.Split(bufio.ScanLines)
 
 	contents := [][]byte{}
-	for scanner.Scan() {
-		rawContent := scanner.Text()
-		content, err := hex.DecodeString(rawContent)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		content, err := decode(scanner.Text())
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("%s:%d: %w", filename, lineNo, err)
 		}
 
 		contents = append(contents, content)
 	}
 
-	return contents
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return contents, nil
 }
 
 // randomAESCipher encrypts a message randomly with either ECB or CBC
@@ -171,17 +421,18 @@ func randomAESCipher(message []byte, blockSize int) []byte {
 	if (key[0] & 1) > 0 {
 		iv := randomBytes(blockSize)
 
-		return encryptAESCBC(newMessage, iv, key)
+		return mustEncryptAESCBC(newMessage, iv, key)
 	}
 
-	return encryptAESECB(newMessage, key)
+	return mustEncryptAESECB(pks7Pad(newMessage, blockSize), key)
 }
 
-// parseQueryString takes in a query string like a=1&b=2 and returns a map[string]string
-func parseQueryString(query string) map[string]string {
+// parseQueryString takes in a query string like a=1&b=2 and returns a
+// map[string]string, or ErrInvalidEncoding for bad input
+func parseQueryString(query string) (map[string]string, error) {
 	v, err := url.ParseQuery(query)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
 	}
 
 	ourMap := map[string]string{}
@@ -192,6 +443,16 @@ func parseQueryString(query string) map[string]string {
 		ourMap[k] = vs[0]
 	}
 
+	return ourMap, nil
+}
+
+// mustParseQueryString is like parseQueryString but panics on error
+func mustParseQueryString(query string) map[string]string {
+	ourMap, err := parseQueryString(query)
+	if err != nil {
+		panic(err)
+	}
+
 	return ourMap
 }
 
@@ -209,7 +470,7 @@ func profileFor(emailAddress string) string {
 // encryptedProfileFor creates a user profile and encrypts it with a static key
 func encryptedProfileFor(emailAddress string) []byte {
 	prepareCipherOracles()
-	return encryptAESECB([]byte(profileFor(emailAddress)), unknownOracleKey)
+	return mustEncryptAESECB(pks7Pad([]byte(profileFor(emailAddress)), 16), unknownOracleKey)
 }
 
 // prepareUserData creates a fake user data string
@@ -249,3 +510,37 @@ func sha1HashToRegisters(hash []byte) [5]uint32 {
 	}
 	return regs
 }
+
+// md4Pad should correctly pad the given message the same as the MD4 library.
+// It's the same as sha1Pad except the length is little-endian
+func md4Pad(message []byte) []byte {
+	len := len(message)
+	// Padding.  Add a 1 bit and 0 bits until 56 bytes mod 64.
+	var tmp [64]byte
+	tmp[0] = 0x80
+	if len%64 < 56 {
+		message = append(message, tmp[0:56-len%64]...)
+	} else {
+		message = append(message, tmp[0:64+56-len%64]...)
+	}
+
+	len <<= 3
+	for i := uint(0); i < 8; i++ {
+		tmp[i] = byte(len >> (8 * i))
+	}
+
+	message = append(message, tmp[0:8]...)
+
+	return message
+}
+
+func md4HashToRegisters(hash []byte) [4]uint32 {
+	regs := [4]uint32{}
+	for i := range regs {
+		regs[i] = (uint32(hash[i*4])) |
+			(uint32(hash[(i*4)+1]) << 8) |
+			(uint32(hash[(i*4)+2]) << 16) |
+			(uint32(hash[(i*4)+3]) << 24)
+	}
+	return regs
+}